@@ -0,0 +1,755 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// message batches api
+// ---------------------
+type BatchConfig struct {
+	DataDir           string `json:"data_dir,omitempty"`
+	Workers           int    `json:"workers,omitempty"`
+	RequestsPerMinute int    `json:"requests_per_minute,omitempty"`
+}
+
+// defaults of batch config
+const (
+	defaultBatchDataDir           = "data"
+	defaultBatchWorkers           = 4
+	defaultBatchRequestsPerMinute = 60
+)
+
+// limits of the anthropic batches api
+const (
+	maxBatchRequests  = 100000
+	maxBatchBodySize  = 256 << 20
+	batchExpiresAfter = 24 * time.Hour
+)
+
+// page size of batch list
+const (
+	defaultBatchListLimit = 20
+	maxBatchListLimit     = 100
+)
+
+// processing_status of batches
+const (
+	BatchStatusInProgress = "in_progress"
+	BatchStatusCanceling  = "canceling"
+	BatchStatusEnded      = "ended"
+)
+
+// result types of batch requests
+const (
+	BatchResultSucceeded = "succeeded"
+	BatchResultErrored   = "errored"
+	BatchResultCanceled  = "canceled"
+	BatchResultExpired   = "expired"
+)
+
+// load batch config from env
+func LoadBatchConfigWithEnv() *BatchConfig {
+	workers, _ := strconv.Atoi(os.Getenv("BATCH_WORKERS"))
+	requestsPerMinute, _ := strconv.Atoi(os.Getenv("BATCH_REQUESTS_PER_MINUTE"))
+	return &BatchConfig{
+		DataDir:           os.Getenv("BATCH_DATA_DIR"),
+		Workers:           workers,
+		RequestsPerMinute: requestsPerMinute,
+	}
+}
+
+func (config *BatchConfig) GetDataDir() string {
+	if len(config.DataDir) > 0 {
+		return config.DataDir
+	}
+	return defaultBatchDataDir
+}
+
+func (config *BatchConfig) GetWorkers() int {
+	if config.Workers > 0 {
+		return config.Workers
+	}
+	return defaultBatchWorkers
+}
+
+// requests per minute sent to bedrock by all workers, negative means no limit
+func (config *BatchConfig) GetRequestsPerMinute() int {
+	if config.RequestsPerMinute == 0 {
+		return defaultBatchRequestsPerMinute
+	}
+	return config.RequestsPerMinute
+}
+
+// request.requests[]
+type MessageBatchRequest struct {
+	CustomId string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// request
+type MessageBatchCreateRequest struct {
+	Requests []*MessageBatchRequest `json:"requests"`
+}
+
+// batch.request_counts
+type MessageBatchRequestCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// batch, also persisted as batch.json
+type MessageBatch struct {
+	Id                string                     `json:"id"`
+	Type              string                     `json:"type"`
+	ProcessingStatus  string                     `json:"processing_status"`
+	RequestCounts     *MessageBatchRequestCounts `json:"request_counts"`
+	EndedAt           *string                    `json:"ended_at"`
+	CreatedAt         string                     `json:"created_at"`
+	ExpiresAt         string                     `json:"expires_at"`
+	ArchivedAt        *string                    `json:"archived_at"`
+	CancelInitiatedAt *string                    `json:"cancel_initiated_at"`
+	ResultsUrl        *string                    `json:"results_url"`
+}
+
+// paginated batch list
+type MessageBatchList struct {
+	Data    []*MessageBatch `json:"data"`
+	HasMore bool            `json:"has_more"`
+	FirstId *string         `json:"first_id"`
+	LastId  *string         `json:"last_id"`
+}
+
+// response of deleting a batch
+type MessageBatchDeleted struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// one line of results jsonl
+type MessageBatchResult struct {
+	CustomId string                   `json:"custom_id"`
+	Result   *MessageBatchResultValue `json:"result"`
+}
+
+type MessageBatchResultValue struct {
+	Type    string                           `json:"type"`
+	Message *ClaudeMessageCompletionResponse `json:"message,omitempty"`
+	Error   *APIStandardError                `json:"error,omitempty"`
+}
+
+// call the messages api for one batch request
+type MessageCompleter func(ctx context.Context, req *ClaudeMessageCompletionRequest) (IStreamableResponse, error)
+
+// runs batches with a local worker pool and keeps them on disk
+type BatchManager struct {
+	conf     *BatchConfig
+	dir      string
+	complete MessageCompleter
+	limiter  *rateLimiter
+	tasks    chan *batchTask
+
+	lock    sync.Mutex
+	batches map[string]*batchRun
+}
+
+// state of one batch
+type batchRun struct {
+	batch      *MessageBatch
+	dir        string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	resultLock sync.Mutex
+	inflight   sync.WaitGroup
+}
+
+// context of batch requests, cancelled when the batch is canceled, and done when it expires
+func (run *batchRun) start() {
+	expiresAt, err := time.Parse(time.RFC3339, run.batch.ExpiresAt)
+	if err != nil {
+		run.ctx, run.cancel = context.WithCancel(context.Background())
+		return
+	}
+	run.ctx, run.cancel = context.WithDeadline(context.Background(), expiresAt)
+}
+
+// result of requests not sent or interrupted once the context of batch is done
+func (run *batchRun) stoppedResult() *MessageBatchResultValue {
+	if errors.Is(run.ctx.Err(), context.DeadlineExceeded) {
+		return &MessageBatchResultValue{Type: BatchResultExpired}
+	}
+	return &MessageBatchResultValue{Type: BatchResultCanceled}
+}
+
+// one request sent to workers
+type batchTask struct {
+	run     *batchRun
+	request *MessageBatchRequest
+}
+
+// load batches of data dir, resume the unfinished ones and start workers.
+// the data dir is only created by the first batch
+func NewBatchManager(conf *BatchConfig, complete MessageCompleter) (*BatchManager, error) {
+	manager := &BatchManager{
+		conf:     conf,
+		dir:      filepath.Join(conf.GetDataDir(), "batches"),
+		complete: complete,
+		limiter:  newRateLimiter(conf.GetRequestsPerMinute()),
+		tasks:    make(chan *batchTask),
+		batches:  map[string]*batchRun{},
+	}
+
+	for i := 0; i < conf.GetWorkers(); i++ {
+		go manager.work()
+	}
+
+	entries, err := os.ReadDir(manager.dir)
+	if os.IsNotExist(err) {
+		return manager, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		err := manager.load(entry.Name())
+		if err != nil {
+			Log.Errorf("unable to load batch %s, %v", entry.Name(), err)
+		}
+	}
+	return manager, nil
+}
+
+// msgbatch_xxx
+func newBatchId() string {
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	return "msgbatch_" + hex.EncodeToString(raw)
+}
+
+// snapshot of batch, safe to encode without lock
+func (manager *BatchManager) snapshot(run *batchRun) *MessageBatch {
+	batch := *run.batch
+	counts := *run.batch.RequestCounts
+	batch.RequestCounts = &counts
+	return &batch
+}
+
+// persist batch.json, the caller must hold the lock
+func (manager *BatchManager) save(run *batchRun) error {
+	raw, err := json.Marshal(run.batch)
+	if err != nil {
+		return err
+	}
+	// write then rename, so a crash never leaves a partial file
+	path := filepath.Join(run.dir, "batch.json")
+	err = os.WriteFile(path+".tmp", raw, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// validate requests and start a new batch
+func (manager *BatchManager) Create(req *MessageBatchCreateRequest) (*MessageBatch, error) {
+	if len(req.Requests) == 0 {
+		return nil, NewInvalidRequestError(fmt.Errorf("requests is required"))
+	}
+	if len(req.Requests) > maxBatchRequests {
+		return nil, NewInvalidRequestError(fmt.Errorf("a batch can contain at most %d requests", maxBatchRequests))
+	}
+	customIds := map[string]bool{}
+	for i, request := range req.Requests {
+		if len(request.CustomId) == 0 {
+			return nil, NewInvalidRequestError(fmt.Errorf("requests.%d.custom_id is required", i))
+		}
+		if customIds[request.CustomId] {
+			return nil, NewInvalidRequestError(fmt.Errorf("duplicate custom_id: %s", request.CustomId))
+		}
+		customIds[request.CustomId] = true
+		var params ClaudeMessageCompletionRequest
+		err := json.Unmarshal(request.Params, &params)
+		if err != nil {
+			return nil, NewInvalidRequestError(fmt.Errorf("requests.%d.params: %v", i, err))
+		}
+		if params.MaxToken <= 0 {
+			return nil, NewInvalidRequestError(fmt.Errorf("requests.%d.params.max_tokens is required", i))
+		}
+		err = params.ValidateTools()
+		if err != nil {
+			return nil, NewInvalidRequestError(fmt.Errorf("requests.%d.params.%v", i, err))
+		}
+	}
+
+	now := time.Now().UTC()
+	id := newBatchId()
+	resultsUrl := fmt.Sprintf("/v1/messages/batches/%s/results", id)
+	run := &batchRun{
+		batch: &MessageBatch{
+			Id:               id,
+			Type:             "message_batch",
+			ProcessingStatus: BatchStatusInProgress,
+			RequestCounts:    &MessageBatchRequestCounts{Processing: len(req.Requests)},
+			CreatedAt:        now.Format(time.RFC3339),
+			ExpiresAt:        now.Add(batchExpiresAfter).Format(time.RFC3339),
+			ResultsUrl:       &resultsUrl,
+		},
+		dir: filepath.Join(manager.dir, id),
+	}
+	run.start()
+
+	err := os.MkdirAll(run.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	var requests bytes.Buffer
+	for _, request := range req.Requests {
+		raw, _ := json.Marshal(request)
+		requests.Write(raw)
+		requests.WriteByte('\n')
+	}
+	err = os.WriteFile(filepath.Join(run.dir, "requests.jsonl"), requests.Bytes(), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.lock.Lock()
+	err = manager.save(run)
+	if err == nil {
+		manager.batches[id] = run
+	}
+	batch := manager.snapshot(run)
+	manager.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	go manager.dispatch(run, map[string]bool{})
+	return batch, nil
+}
+
+// load a batch from disk and resume it if not ended
+func (manager *BatchManager) load(id string) error {
+	run := &batchRun{dir: filepath.Join(manager.dir, id)}
+	raw, err := os.ReadFile(filepath.Join(run.dir, "batch.json"))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(raw, &run.batch)
+	if err != nil {
+		return err
+	}
+
+	if run.batch.ProcessingStatus == BatchStatusEnded {
+		manager.lock.Lock()
+		manager.batches[id] = run
+		manager.lock.Unlock()
+		return nil
+	}
+	run.start()
+
+	// count requests and the results written before restart
+	total, err := countLines(filepath.Join(run.dir, "requests.jsonl"))
+	if err != nil {
+		return err
+	}
+	done, counts, err := readBatchResults(filepath.Join(run.dir, "results.jsonl"))
+	if err != nil {
+		return err
+	}
+	counts.Processing = total - len(done)
+	run.batch.RequestCounts = counts
+	if run.batch.ProcessingStatus == BatchStatusCanceling {
+		run.cancel()
+	}
+
+	manager.lock.Lock()
+	manager.batches[id] = run
+	manager.lock.Unlock()
+
+	Log.Infof("resume batch %s, %d requests left", id, counts.Processing)
+	go manager.dispatch(run, done)
+	return nil
+}
+
+// number of lines of file
+func countLines(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	count := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			count++
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// custom ids and counts of results, a partial last line left by a crash is removed
+func readBatchResults(path string) (map[string]bool, *MessageBatchRequestCounts, error) {
+	done := map[string]bool{}
+	counts := &MessageBatchRequestCounts{}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		size += int64(len(line))
+		var result MessageBatchResult
+		if json.Unmarshal(line, &result) != nil || result.Result == nil {
+			continue
+		}
+		done[result.CustomId] = true
+		switch result.Result.Type {
+		case BatchResultSucceeded:
+			counts.Succeeded++
+		case BatchResultErrored:
+			counts.Errored++
+		case BatchResultCanceled:
+			counts.Canceled++
+		case BatchResultExpired:
+			counts.Expired++
+		}
+	}
+	return done, counts, file.Truncate(size)
+}
+
+// send requests of batch to workers, requests in done are skipped.
+// the remaining requests are canceled or expired when the batch is canceled or expires
+func (manager *BatchManager) dispatch(run *batchRun, done map[string]bool) {
+	defer manager.end(run)
+
+	file, err := os.Open(filepath.Join(run.dir, "requests.jsonl"))
+	if err != nil {
+		Log.Errorf("unable to read batch %s, %v", run.batch.Id, err)
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var request MessageBatchRequest
+			if json.Unmarshal(line, &request) == nil && !done[request.CustomId] {
+				manager.dispatchOne(run, &request)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				Log.Errorf("unable to read batch %s, %v", run.batch.Id, err)
+			}
+			break
+		}
+	}
+	run.inflight.Wait()
+}
+
+func (manager *BatchManager) dispatchOne(run *batchRun, request *MessageBatchRequest) {
+	if run.ctx.Err() != nil {
+		manager.writeResult(run, request.CustomId, run.stoppedResult())
+		return
+	}
+	run.inflight.Add(1)
+	select {
+	case manager.tasks <- &batchTask{run: run, request: request}:
+	case <-run.ctx.Done():
+		run.inflight.Done()
+		manager.writeResult(run, request.CustomId, run.stoppedResult())
+	}
+}
+
+// worker of all batches
+func (manager *BatchManager) work() {
+	for task := range manager.tasks {
+		result := manager.process(task)
+		manager.writeResult(task.run, task.request.CustomId, result)
+		task.run.inflight.Done()
+	}
+}
+
+// call messages api, throttled calls are already retried by the router within its budget.
+// the call is interrupted when the batch is canceled or expires
+func (manager *BatchManager) process(task *batchTask) *MessageBatchResultValue {
+	if manager.limiter.Wait(task.run.ctx) != nil {
+		return task.run.stoppedResult()
+	}
+
+	var req ClaudeMessageCompletionRequest
+	err := json.Unmarshal(task.request.Params, &req)
+	if err != nil {
+		return newBatchErrorResult(NewInvalidRequestError(err))
+	}
+	req.Stream = false
+
+	response, err := manager.complete(task.run.ctx, &req)
+	if task.run.ctx.Err() != nil {
+		return task.run.stoppedResult()
+	}
+	if err != nil {
+		Log.Warningf("batch %s request %s failed, %v", task.run.batch.Id, task.request.CustomId, err)
+		return newBatchErrorResult(err)
+	}
+	resp, ok := response.GetResponse().(*ClaudeMessageCompletionResponse)
+	if !ok || resp == nil {
+		return newBatchErrorResult(fmt.Errorf("empty response from bedrock"))
+	}
+	return &MessageBatchResultValue{Type: BatchResultSucceeded, Message: resp}
+}
+
+func newBatchErrorResult(err error) *MessageBatchResultValue {
+	apiErr := TranslateError(err)
+	return &MessageBatchResultValue{
+		Type: BatchResultErrored,
+		Error: &APIStandardError{Type: "error", Error: &APIError{
+			Type:    apiErr.Type,
+			Message: apiErr.Message,
+		}},
+	}
+}
+
+// append result to results.jsonl and update request counts
+func (manager *BatchManager) writeResult(run *batchRun, customId string, result *MessageBatchResultValue) {
+	raw, _ := json.Marshal(&MessageBatchResult{CustomId: customId, Result: result})
+	raw = append(raw, '\n')
+
+	run.resultLock.Lock()
+	file, err := os.OpenFile(filepath.Join(run.dir, "results.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = file.Write(raw)
+		file.Close()
+	}
+	run.resultLock.Unlock()
+	if err != nil {
+		Log.Errorf("unable to write result of batch %s, %v", run.batch.Id, err)
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	counts := run.batch.RequestCounts
+	counts.Processing--
+	switch result.Type {
+	case BatchResultSucceeded:
+		counts.Succeeded++
+	case BatchResultErrored:
+		counts.Errored++
+	case BatchResultCanceled:
+		counts.Canceled++
+	case BatchResultExpired:
+		counts.Expired++
+	}
+	CountMetric("batch_requests." + result.Type)
+}
+
+// all requests have results
+func (manager *BatchManager) end(run *batchRun) {
+	// release the expiry timer of the context
+	run.cancel()
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	endedAt := time.Now().UTC().Format(time.RFC3339)
+	run.batch.ProcessingStatus = BatchStatusEnded
+	run.batch.EndedAt = &endedAt
+	err := manager.save(run)
+	if err != nil {
+		Log.Errorf("unable to save batch %s, %v", run.batch.Id, err)
+	}
+	Log.Infof("batch %s ended", run.batch.Id)
+}
+
+// error of unknown batch id
+func newBatchNotFoundError(id string) error {
+	return &ClaudeAPIError{
+		Type:       ErrorTypeNotFound,
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf("batch not found: %s", id),
+	}
+}
+
+func (manager *BatchManager) Get(id string) (*MessageBatch, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	run, exist := manager.batches[id]
+	if !exist {
+		return nil, newBatchNotFoundError(id)
+	}
+	return manager.snapshot(run), nil
+}
+
+// stop sending requests of batch, bedrock calls in flight are interrupted
+func (manager *BatchManager) Cancel(id string) (*MessageBatch, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	run, exist := manager.batches[id]
+	if !exist {
+		return nil, newBatchNotFoundError(id)
+	}
+	if run.batch.ProcessingStatus == BatchStatusInProgress {
+		now := time.Now().UTC().Format(time.RFC3339)
+		run.batch.ProcessingStatus = BatchStatusCanceling
+		run.batch.CancelInitiatedAt = &now
+		err := manager.save(run)
+		if err != nil {
+			return nil, err
+		}
+		run.cancel()
+	}
+	return manager.snapshot(run), nil
+}
+
+// remove an ended batch and its results
+func (manager *BatchManager) Delete(id string) (*MessageBatchDeleted, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	run, exist := manager.batches[id]
+	if !exist {
+		return nil, newBatchNotFoundError(id)
+	}
+	if run.batch.ProcessingStatus != BatchStatusEnded {
+		return nil, NewInvalidRequestError(fmt.Errorf("batch %s is still processing, cancel it first", id))
+	}
+	err := os.RemoveAll(run.dir)
+	if err != nil {
+		return nil, err
+	}
+	delete(manager.batches, id)
+	return &MessageBatchDeleted{Id: id, Type: "message_batch_deleted"}, nil
+}
+
+// path of results.jsonl, only available once the batch ended
+func (manager *BatchManager) ResultsPath(id string) (string, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	run, exist := manager.batches[id]
+	if !exist {
+		return "", newBatchNotFoundError(id)
+	}
+	if run.batch.ProcessingStatus != BatchStatusEnded {
+		return "", NewInvalidRequestError(fmt.Errorf("batch %s is still processing", id))
+	}
+	return filepath.Join(run.dir, "results.jsonl"), nil
+}
+
+// one page of batches, newest first, after_id and before_id are exclusive
+func (manager *BatchManager) List(afterId string, beforeId string, limit int) (*MessageBatchList, error) {
+	manager.lock.Lock()
+	batches := []*MessageBatch{}
+	for _, run := range manager.batches {
+		batches = append(batches, manager.snapshot(run))
+	}
+	manager.lock.Unlock()
+	sort.Slice(batches, func(i, j int) bool {
+		if batches[i].CreatedAt != batches[j].CreatedAt {
+			return batches[i].CreatedAt > batches[j].CreatedAt
+		}
+		return batches[i].Id > batches[j].Id
+	})
+
+	indexOf := func(id string) (int, error) {
+		for i, batch := range batches {
+			if batch.Id == id {
+				return i, nil
+			}
+		}
+		return -1, newBatchNotFoundError(id)
+	}
+
+	start, end, hasMore, err := listPage(len(batches), indexOf, afterId, beforeId, limit, defaultBatchListLimit, maxBatchListLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &MessageBatchList{
+		Data:    batches[start:end],
+		HasMore: hasMore,
+	}
+	if len(list.Data) > 0 {
+		list.FirstId = &list.Data[0].Id
+		list.LastId = &list.Data[len(list.Data)-1].Id
+	}
+	return list, nil
+}
+
+// spaces requests evenly, shared by all workers
+type rateLimiter struct {
+	interval time.Duration
+	lock     sync.Mutex
+	next     time.Time
+}
+
+// no limit if requestsPerMinute <= 0
+func newRateLimiter(requestsPerMinute int) *rateLimiter {
+	limiter := &rateLimiter{}
+	if requestsPerMinute > 0 {
+		limiter.interval = time.Minute / time.Duration(requestsPerMinute)
+	}
+	return limiter
+}
+
+// wait for the next slot, return error if ctx is done first
+func (limiter *rateLimiter) Wait(ctx context.Context) error {
+	if limiter.interval <= 0 {
+		return ctx.Err()
+	}
+	limiter.lock.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	wait := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(limiter.interval)
+	limiter.lock.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
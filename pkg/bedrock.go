@@ -5,16 +5,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	bedrock "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	stsTypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
 )
 
 // ------------------
@@ -22,18 +26,74 @@ import (
 // ------------------
 // bedrock config struct
 type BedrockConfig struct {
-	AccessKey                string            `json:"access_key"`
-	SecretKey                string            `json:"secret_key"`
-	Region                   string            `json:"region"`
-	RoleArn                  string            `json:"role_arn"`
-	RoleRegion               string            `json:"role_region"`
-	AnthropicVersionMappings map[string]string `json:"anthropic_version_mappings"`
-	ModelMappings            map[string]string `json:"model_mappings"`
-	AnthropicDefaultModel    string            `json:"anthropic_default_model"`
-	AnthropicDefaultVersion  string            `json:"anthropic_default_version"`
-}
-
-// bedrock client struct
+	CredentialMode            string                `json:"credential_mode,omitempty"`
+	AccessKey                 string                `json:"access_key"`
+	SecretKey                 string                `json:"secret_key"`
+	Profile                   string                `json:"profile,omitempty"`
+	WebIdentityRoleArn        string                `json:"web_identity_role_arn,omitempty"`
+	WebIdentityTokenFile      string                `json:"web_identity_token_file,omitempty"`
+	Region                    string                `json:"region"`
+	RoleArn                   string                `json:"role_arn"`
+	RoleRegion                string                `json:"role_region"`
+	RoleExternalId            string                `json:"role_external_id,omitempty"`
+	RoleSessionName           string                `json:"role_session_name,omitempty"`
+	RoleDurationSeconds       int                   `json:"role_duration_seconds,omitempty"`
+	RoleSessionTags           map[string]string     `json:"role_session_tags,omitempty"`
+	RoleChain                 []*AssumeRoleConfig   `json:"role_chain,omitempty"`
+	AnthropicVersionMappings  map[string]string     `json:"anthropic_version_mappings"`
+	ModelMappings             map[string]ModelChain `json:"model_mappings"`
+	FallbackOn                []string              `json:"fallback_on,omitempty"`
+	InferenceProfilePrefix    string                `json:"inference_profile_prefix,omitempty"`
+	DiscoverInferenceProfiles bool                  `json:"discover_inference_profiles,omitempty"`
+	AnthropicDefaultModel     string                `json:"anthropic_default_model"`
+	AnthropicDefaultVersion   string                `json:"anthropic_default_version"`
+	UpstreamTimeout           int                   `json:"upstream_timeout,omitempty"`
+	ModelTimeouts             map[string]int        `json:"model_timeouts,omitempty"`
+	DefaultBackend            string                `json:"default_backend,omitempty"`
+	ModelBackends             map[string]string     `json:"model_backends,omitempty"`
+	Guardrail                 *GuardrailConfig      `json:"guardrail,omitempty"`
+	Targets                   []*BedrockTarget      `json:"targets,omitempty"`
+	Routing                   string                `json:"routing,omitempty"`
+	CircuitBreaker            *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+	Retry                     *RetryConfig          `json:"retry,omitempty"`
+	ForwardFields             []string              `json:"forward_fields,omitempty"`
+	DropFields                []string              `json:"drop_fields,omitempty"`
+	// inference profiles discovered by the client of this config
+	inferenceProfiles *inferenceProfileSet
+}
+
+// options of one assumed role
+type AssumeRoleConfig struct {
+	RoleArn           string            `json:"role_arn"`
+	ExternalId        string            `json:"external_id,omitempty"`
+	SessionName       string            `json:"session_name,omitempty"`
+	DurationSeconds   int               `json:"duration_seconds,omitempty"`
+	SessionTags       map[string]string `json:"session_tags,omitempty"`
+	TransitiveTagKeys []string          `json:"transitive_tag_keys,omitempty"`
+}
+
+// default RoleSessionName of assumed roles
+const defaultRoleSessionName = "bedrockruntime-session"
+
+// base credential sources of bedrock config
+const (
+	// access_key + secret_key
+	CredentialModeStatic = "static"
+	// aws default chain: env, shared config, sso, web identity, ecs, imds
+	CredentialModeDefault = "default"
+	// named profile in shared config
+	CredentialModeProfile = "profile"
+	// web identity token file, e.g. EKS IRSA
+	CredentialModeWebIdentity = "web_identity"
+)
+
+// refresh assumed role credentials this long before they expire
+const credentialsExpiryWindow = 5 * time.Minute
+
+// max time to wait for credentials while creating client
+const credentialsCheckTimeout = 30 * time.Second
+
+// bedrock client struct, safe for concurrent use
 type BedrockClient struct {
 	config *BedrockConfig
 	client *bedrock.Client
@@ -57,19 +117,185 @@ func ParseMappingsFromStr(raw string) map[string]string {
 	return mappings
 }
 
+// parse comma separated list str
+func ParseListFromStr(raw string) []string {
+	items := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // load bedrock config from env
 func LoadBedrockConfigWithEnv() *BedrockConfig {
+	roleDurationSeconds, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_ROLE_DURATION_SECONDS"))
+	upstreamTimeout, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_UPSTREAM_TIMEOUT"))
+	modelTimeouts := map[string]int{}
+	for model, timeout := range ParseMappingsFromStr(os.Getenv("AWS_BEDROCK_MODEL_TIMEOUTS")) {
+		seconds, err := strconv.Atoi(timeout)
+		if err == nil {
+			modelTimeouts[model] = seconds
+		}
+	}
+	var guardrail *GuardrailConfig
+	if len(os.Getenv("AWS_BEDROCK_GUARDRAIL_ID")) > 0 {
+		guardrail = &GuardrailConfig{
+			Identifier: os.Getenv("AWS_BEDROCK_GUARDRAIL_ID"),
+			Version:    os.Getenv("AWS_BEDROCK_GUARDRAIL_VERSION"),
+			Trace:      os.Getenv("AWS_BEDROCK_GUARDRAIL_TRACE"),
+		}
+	}
+	var roleChain []*AssumeRoleConfig
+	for _, roleArn := range strings.Split(os.Getenv("AWS_BEDROCK_ROLE_CHAIN"), ",") {
+		roleArn = strings.TrimSpace(roleArn)
+		if len(roleArn) > 0 {
+			roleChain = append(roleChain, &AssumeRoleConfig{RoleArn: roleArn})
+		}
+	}
+
 	return &BedrockConfig{
-		AccessKey:                os.Getenv("AWS_BEDROCK_ACCESS_KEY"),
-		SecretKey:                os.Getenv("AWS_BEDROCK_SECRET_KEY"),
-		Region:                   os.Getenv("AWS_BEDROCK_REGION"),
-		RoleArn:                  os.Getenv("AWS_BEDROCK_ROLE_ARN"),
-		RoleRegion:               os.Getenv("AWS_BEDROCK_ROLE_REGION"),
-		ModelMappings:            ParseMappingsFromStr(os.Getenv("AWS_BEDROCK_MODEL_MAPPINGS")),
-		AnthropicVersionMappings: ParseMappingsFromStr(os.Getenv("AWS_BEDROCK_ANTHROPIC_VERSION_MAPPINGS")),
-		AnthropicDefaultModel:    os.Getenv("AWS_BEDROCK_ANTHROPIC_DEFAULT_MODEL"),
-		AnthropicDefaultVersion:  os.Getenv("AWS_BEDROCK_ANTHROPIC_DEFAULT_VERSION"),
+		CredentialMode:            os.Getenv("AWS_BEDROCK_CREDENTIAL_MODE"),
+		AccessKey:                 os.Getenv("AWS_BEDROCK_ACCESS_KEY"),
+		SecretKey:                 os.Getenv("AWS_BEDROCK_SECRET_KEY"),
+		Profile:                   os.Getenv("AWS_BEDROCK_PROFILE"),
+		WebIdentityRoleArn:        os.Getenv("AWS_BEDROCK_WEB_IDENTITY_ROLE_ARN"),
+		WebIdentityTokenFile:      os.Getenv("AWS_BEDROCK_WEB_IDENTITY_TOKEN_FILE"),
+		Region:                    os.Getenv("AWS_BEDROCK_REGION"),
+		RoleArn:                   os.Getenv("AWS_BEDROCK_ROLE_ARN"),
+		RoleRegion:                os.Getenv("AWS_BEDROCK_ROLE_REGION"),
+		RoleExternalId:            os.Getenv("AWS_BEDROCK_ROLE_EXTERNAL_ID"),
+		RoleSessionName:           os.Getenv("AWS_BEDROCK_ROLE_SESSION_NAME"),
+		RoleDurationSeconds:       roleDurationSeconds,
+		RoleSessionTags:           ParseMappingsFromStr(os.Getenv("AWS_BEDROCK_ROLE_SESSION_TAGS")),
+		RoleChain:                 roleChain,
+		ModelMappings:             ParseModelMappingsFromStr(os.Getenv("AWS_BEDROCK_MODEL_MAPPINGS")),
+		FallbackOn:                loadFallbackOnWithEnv(),
+		InferenceProfilePrefix:    os.Getenv("AWS_BEDROCK_INFERENCE_PROFILE_PREFIX"),
+		DiscoverInferenceProfiles: os.Getenv("AWS_BEDROCK_DISCOVER_INFERENCE_PROFILES") == "true",
+		AnthropicVersionMappings:  ParseMappingsFromStr(os.Getenv("AWS_BEDROCK_ANTHROPIC_VERSION_MAPPINGS")),
+		AnthropicDefaultModel:     os.Getenv("AWS_BEDROCK_ANTHROPIC_DEFAULT_MODEL"),
+		AnthropicDefaultVersion:   os.Getenv("AWS_BEDROCK_ANTHROPIC_DEFAULT_VERSION"),
+		UpstreamTimeout:           upstreamTimeout,
+		ModelTimeouts:             modelTimeouts,
+		DefaultBackend:            os.Getenv("AWS_BEDROCK_DEFAULT_BACKEND"),
+		ModelBackends:             ParseMappingsFromStr(os.Getenv("AWS_BEDROCK_MODEL_BACKENDS")),
+		ForwardFields:             ParseListFromStr(os.Getenv("AWS_BEDROCK_FORWARD_FIELDS")),
+		DropFields:                ParseListFromStr(os.Getenv("AWS_BEDROCK_DROP_FIELDS")),
+		Guardrail:                 guardrail,
+		Targets:                   parseTargetRegions(os.Getenv("AWS_BEDROCK_TARGET_REGIONS")),
+		Routing:                   os.Getenv("AWS_BEDROCK_ROUTING"),
+		CircuitBreaker:            loadCircuitBreakerWithEnv(),
+		Retry:                     loadRetryConfigWithEnv(),
+	}
+}
+
+// credential mode, static keys if configured otherwise the default chain
+func (config *BedrockConfig) GetCredentialMode() string {
+	if len(config.CredentialMode) > 0 {
+		return strings.ToLower(config.CredentialMode)
+	}
+	if len(config.AccessKey) > 0 {
+		return CredentialModeStatic
+	}
+	return CredentialModeDefault
+}
+
+// roles to assume in order, role_arn first and then role_chain
+func (config *BedrockConfig) GetAssumeRoleChain() []*AssumeRoleConfig {
+	chain := []*AssumeRoleConfig{}
+	if len(config.RoleArn) > 0 {
+		chain = append(chain, &AssumeRoleConfig{
+			RoleArn:         config.RoleArn,
+			ExternalId:      config.RoleExternalId,
+			SessionName:     config.RoleSessionName,
+			DurationSeconds: config.RoleDurationSeconds,
+			SessionTags:     config.RoleSessionTags,
+		})
+	}
+	for _, role := range config.RoleChain {
+		if role != nil && len(role.RoleArn) > 0 {
+			chain = append(chain, role)
+		}
+	}
+	return chain
+}
+
+// apply to stscreds assume role options
+func (role *AssumeRoleConfig) apply(options *stscreds.AssumeRoleOptions) {
+	options.RoleSessionName = defaultRoleSessionName
+	if len(role.SessionName) > 0 {
+		options.RoleSessionName = role.SessionName
+	}
+	if len(role.ExternalId) > 0 {
+		options.ExternalID = aws.String(role.ExternalId)
+	}
+	if role.DurationSeconds > 0 {
+		options.Duration = time.Duration(role.DurationSeconds) * time.Second
+	}
+	if len(role.SessionTags) > 0 {
+		keys := make([]string, 0, len(role.SessionTags))
+		for key := range role.SessionTags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			options.Tags = append(options.Tags, stsTypes.Tag{
+				Key:   aws.String(key),
+				Value: aws.String(role.SessionTags[key]),
+			})
+		}
+	}
+	if len(role.TransitiveTagKeys) > 0 {
+		options.TransitiveTagKeys = role.TransitiveTagKeys
+	}
+}
+
+// bedrock model id of alias, the first model of its chain
+func (config *BedrockConfig) GetModelId(model string) string {
+	return config.GetModelChain(model).First()
+}
+
+// bedrock anthropic_version of anthropic-version header
+func (config *BedrockConfig) GetAnthropicVersion(version string) string {
+	apiVersion, exist := config.AnthropicVersionMappings[version]
+	if exist {
+		version = apiVersion
+	}
+	if len(version) == 0 {
+		version = config.AnthropicDefaultVersion
 	}
+	return version
+}
+
+// timeout of one bedrock call, model_timeouts by alias, model id or foundation model id first, then upstream_timeout
+func (config *BedrockConfig) GetUpstreamTimeout(model string, modelId string) time.Duration {
+	for _, key := range []string{model, modelId, FoundationModelId(modelId)} {
+		seconds, exist := config.ModelTimeouts[key]
+		if exist && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return time.Duration(config.UpstreamTimeout) * time.Second
+}
+
+// context of one bedrock call, cancelled when the client goes away or the upstream timeout is reached
+func (client *BedrockClient) upstreamContext(ctx context.Context, model string, modelId string) (context.Context, context.CancelFunc) {
+	timeout := client.config.GetUpstreamTimeout(model, modelId)
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// region of bedrock runtime when using assumed role
+func (config *BedrockConfig) GetRoleRegion() string {
+	if len(config.RoleRegion) > 0 {
+		return config.RoleRegion
+	}
+	return config.Region
 }
 
 // invoke endpoint api
@@ -82,61 +308,140 @@ func (config *BedrockConfig) GetInvokeStreamEndpoint(modelId string, region stri
 	return fmt.Sprintf("bedrock-runtime.%s.amazonaws.com/model/%s/invoke-with-response-stream", region, modelId)
 }
 
-// create bedrock client from config
-func NewBedrockClient(config *BedrockConfig) *BedrockClient {
-	staticProvider := credentials.NewStaticCredentialsProvider(config.AccessKey, config.SecretKey, "")
+// error while retrieving aws credentials
+type CredentialsError struct {
+	Err error
+}
 
-	cfg, err := awsConfig.LoadDefaultConfig(context.TODO(),
-		awsConfig.WithRegion(config.Region),
-		awsConfig.WithCredentialsProvider(staticProvider))
+func (e *CredentialsError) Error() string {
+	return fmt.Sprintf("unable to retrieve aws credentials, %v", e.Err)
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// create bedrock client from config
+func NewBedrockClient(config *BedrockConfig) (*BedrockClient, error) {
+	cfg, err := loadBaseAWSConfig(config)
 	if err != nil {
-		log.Fatalf("unable to load SDK config, %v", err)
+		return nil, err
 	}
 
-	// if not set RoleArn
-	if config.RoleArn == "" {
-		return &BedrockClient{
-			config: config,
-			client: bedrock.NewFromConfig(cfg),
-		}
+	// if no role to assume
+	roleChain := config.GetAssumeRoleChain()
+	if len(roleChain) == 0 {
+		return newBedrockClientFromConfig(config, cfg)
 	}
 
 	// ===== assume role ======
-	stsSvc := sts.NewFromConfig(cfg)
-
-	// Assume role
-	input := &sts.AssumeRoleInput{
-		RoleArn:         aws.String(config.RoleArn),
-		RoleSessionName: aws.String("bedrockruntime-session"),
-	}
-	result, err := stsSvc.AssumeRole(context.TODO(), input)
-	if err != nil {
-		log.Fatalf("unable to assume role, %v", err)
-		return nil
+	// each role is assumed with the credentials of the previous one,
+	// roles are assumed lazily and the credentials cache refresh them before expired
+	assumedCreds := cfg.Credentials
+	for _, role := range roleChain {
+		baseCreds := assumedCreds
+		stsSvc := sts.NewFromConfig(cfg, func(options *sts.Options) {
+			options.Credentials = baseCreds
+		})
+		assumedCreds = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsSvc, role.RoleArn, role.apply),
+			func(options *aws.CredentialsCacheOptions) {
+				options.ExpiryWindow = credentialsExpiryWindow
+			})
 	}
 
-	// Use assumed role to create new credentials
-	assumedCreds := aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(
-		*result.Credentials.AccessKeyId,
-		*result.Credentials.SecretAccessKey,
-		*result.Credentials.SessionToken,
-	))
-
 	// Create a BedrockRuntime client using the assumed role credentials
 	bedrock_cfg, err := awsConfig.LoadDefaultConfig(
 		context.TODO(),
-		awsConfig.WithRegion(config.RoleRegion),
+		awsConfig.WithRegion(config.GetRoleRegion()),
 		awsConfig.WithCredentialsProvider(assumedCreds),
 	)
 	if err != nil {
-		log.Fatalf("unable to create bedrock runtime with assummed role, %v", err)
-		return nil
+		return nil, fmt.Errorf("unable to create bedrock runtime with assummed role, %w", err)
+	}
+
+	return newBedrockClientFromConfig(config, bedrock_cfg)
+}
+
+// load aws config with the base credentials of credential mode
+func loadBaseAWSConfig(config *BedrockConfig) (aws.Config, error) {
+	mode := config.GetCredentialMode()
+	options := []func(*awsConfig.LoadOptions) error{
+		awsConfig.WithRegion(config.Region),
+	}
+	switch mode {
+	case CredentialModeStatic:
+		if config.AccessKey == "" || config.SecretKey == "" {
+			return aws.Config{}, &CredentialsError{Err: fmt.Errorf("access_key and secret_key are required in static mode")}
+		}
+		options = append(options, awsConfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(config.AccessKey, config.SecretKey, "")))
+	case CredentialModeProfile:
+		if config.Profile != "" {
+			options = append(options, awsConfig.WithSharedConfigProfile(config.Profile))
+		}
+	case CredentialModeDefault, CredentialModeWebIdentity:
+	default:
+		return aws.Config{}, fmt.Errorf("unknown credential mode: %s", config.CredentialMode)
+	}
+
+	cfg, err := awsConfig.LoadDefaultConfig(context.TODO(), options...)
+	if err != nil {
+		return cfg, fmt.Errorf("unable to load SDK config, %w", err)
+	}
+
+	if mode != CredentialModeWebIdentity {
+		return cfg, nil
+	}
+
+	// ===== web identity ======
+	roleArn := config.WebIdentityRoleArn
+	if roleArn == "" {
+		roleArn = os.Getenv("AWS_ROLE_ARN")
 	}
+	tokenFile := config.WebIdentityTokenFile
+	if tokenFile == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if roleArn == "" || tokenFile == "" {
+		return cfg, &CredentialsError{Err: fmt.Errorf("web_identity_role_arn and web_identity_token_file are required in web_identity mode")}
+	}
+
+	// AssumeRoleWithWebIdentity does not need signing
+	stsSvc := sts.NewFromConfig(cfg, func(options *sts.Options) {
+		options.Credentials = aws.AnonymousCredentials{}
+	})
+	webIdentityProvider := stscreds.NewWebIdentityRoleProvider(stsSvc, roleArn, stscreds.IdentityTokenFile(tokenFile))
+	cfg.Credentials = aws.NewCredentialsCache(webIdentityProvider, func(options *aws.CredentialsCacheOptions) {
+		options.ExpiryWindow = credentialsExpiryWindow
+	})
 
-	return &BedrockClient{
+	return cfg, nil
+}
+
+// check the credentials can be retrieved before creating the client
+func newBedrockClientFromConfig(config *BedrockConfig, cfg aws.Config) (*BedrockClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsCheckTimeout)
+	defer cancel()
+
+	_, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, &CredentialsError{Err: err}
+	}
+
+	client := &BedrockClient{
 		config: config,
-		client: bedrock.NewFromConfig(bedrock_cfg),
+		// throttling is retried by the router, across targets and failover models
+		client: bedrock.NewFromConfig(cfg, func(options *bedrock.Options) {
+			options.RetryMaxAttempts = 1
+		}),
 	}
+	if config.DiscoverInferenceProfiles {
+		err := client.discoverInferenceProfiles(cfg)
+		if err != nil {
+			Log.Warningf("unable to discover inference profiles, %v", err)
+		}
+	}
+	return client, nil
 }
 
 // ---------------------
@@ -155,7 +460,11 @@ type IStreamableResponse interface {
 	GetEvents() <-chan ISSEDecoder
 }
 
+// event line is omitted when the event has no name
 func NewSSERaw(encoder ISSEDecoder) []byte {
+	if len(encoder.GetEvent()) == 0 {
+		return []byte(fmt.Sprintf("data: %s\n\n", string(encoder.GetBytes())))
+	}
 	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", encoder.GetEvent(), string(encoder.GetBytes())))
 }
 
@@ -166,7 +475,7 @@ func NewSSERaw(encoder ISSEDecoder) []byte {
 type ClaudeTextCompletionRequest struct {
 	Prompt            string   `json:"prompt,omitempty"`
 	MaxTokensToSample int      `json:"max_tokens_to_sample,omitempty"`
-	Temperature       float64  `json:"temperature,omitempty"`
+	Temperature       *float64 `json:"temperature,omitempty"`
 	StopSequences     []string `json:"stop_sequences,omitempty"`
 	TopP              float64  `json:"top_p,omitempty"`
 	TopK              int      `json:"top_k,omitempty"`
@@ -176,6 +485,7 @@ type ClaudeTextCompletionRequest struct {
 
 // response
 type ClaudeTextCompletionResponse struct {
+	Type       string `json:"type,omitempty"`
 	Completion string `json:"completion,omitempty"`
 	StopReason string `json:"stop_reason,omitempty"`
 	Stop       string `json:"stop,omitempty"`
@@ -212,7 +522,9 @@ func (request *ClaudeTextCompletionRequest) UnmarshalJSON(data []byte) error {
 // sse event
 type ClaudeTextCompletionStreamEvent struct {
 	Type       string `json:"type,omitempty"`
+	Id         string `json:"id,omitempty"`
 	StopReason string `json:"stop_reason,omitempty"`
+	Stop       string `json:"stop,omitempty"`
 	Model      string `json:"model,omitempty"`
 	Completion string `json:"completion,omitempty"`
 	Raw        []byte `json:"-"`
@@ -273,74 +585,51 @@ func NewStreamCompleteTextResponse(queue <-chan ISSEDecoder) *CompleteTextRespon
 	}
 }
 
-func (client *BedrockClient) CompleteText(req *ClaudeTextCompletionRequest) (IStreamableResponse, error) {
-	modelId := req.Model
-	mappedModel, exist := client.config.ModelMappings[modelId]
-	if exist {
-		modelId = mappedModel
-	}
-	if len(modelId) == 0 {
-		modelId = client.config.AnthropicDefaultModel
-	}
+func (client *BedrockClient) CompleteText(ctx context.Context, req *ClaudeTextCompletionRequest) (IStreamableResponse, error) {
+	modelId := client.config.GetModelId(req.Model)
 
 	if !strings.HasSuffix(req.Prompt, "Assistant:") {
 		req.Prompt = fmt.Sprintf("\n\nHuman: %s\n\nAssistant:", req.Prompt)
 	}
+	// claude 3 and later reject text completions
+	if !SupportsTextCompletion(modelId) {
+		return client.completeTextWithMessages(ctx, req)
+	}
 	body, err := json.Marshal(req)
 	if err != nil {
 		Log.Errorf("Couldn't marshal the request: ", err)
 		return nil, err
 	}
 
+	ctx, cancel := client.upstreamContext(ctx, req.Model, modelId)
+
 	if req.Stream {
-		output, err := client.client.InvokeModelWithResponseStream(context.Background(), &bedrock.InvokeModelWithResponseStreamInput{
+		output, err := client.client.InvokeModelWithResponseStream(ctx, &bedrock.InvokeModelWithResponseStreamInput{
 			Body:        body,
 			ModelId:     aws.String(modelId),
 			ContentType: aws.String("application/json"),
 		})
 		if err != nil {
+			cancel()
 			Log.Error(err)
 			return nil, err
 		}
 
-		//Log.Debugf("Request: %+v", output)
-
-		reader := output.GetStream()
-		eventQueue := make(chan ISSEDecoder, 10)
-
-		go func() {
-			defer reader.Close()
-			defer close(eventQueue)
-
-			for event := range reader.Events() {
-				switch v := event.(type) {
-				case *types.ResponseStreamMemberChunk:
-
-					//Log.Info("payload", string(v.Value.Bytes))
-
-					var resp ClaudeTextCompletionStreamEvent
-					err := json.NewDecoder(bytes.NewReader(v.Value.Bytes)).Decode(&resp)
-					if err != nil {
-						Log.Error(err)
-						continue
-					}
-					resp.Raw = v.Value.Bytes
-					eventQueue <- &resp
-
-				case *types.UnknownUnionMember:
-					Log.Errorf("unknown tag:", v.Tag)
-					continue
-				default:
-					Log.Errorf("union is nil or unknown type")
-					continue
-				}
+		eventQueue := PumpBedrockStream(ctx, output.GetStream(), func(payload []byte) (ISSEDecoder, error) {
+			var resp ClaudeTextCompletionStreamEvent
+			err := json.NewDecoder(bytes.NewReader(payload)).Decode(&resp)
+			if err != nil {
+				return nil, err
 			}
-		}()
+			resp.Raw = payload
+			return &resp, nil
+		}, cancel)
 
 		return NewStreamCompleteTextResponse(eventQueue), nil
 	}
 
-	output, err := client.client.InvokeModel(context.Background(), &bedrock.InvokeModelInput{
+	defer cancel()
+	output, err := client.client.InvokeModel(ctx, &bedrock.InvokeModelInput{
 		Body:        body,
 		ModelId:     aws.String(modelId),
 		ContentType: aws.String("application/json"),
@@ -375,39 +664,120 @@ type ClaudeMessageCompletionRequestMessage struct {
 	Text    string          `json:"text,omitempty"`
 }
 
+// request.messages[].content[]
+type ClaudeMessageRequestContent struct {
+	Type         string                      `json:"type,omitempty"`
+	Text         string                      `json:"text,omitempty"`
+	Source       *ClaudeMessageContentSource `json:"source,omitempty"`
+	Id           string                      `json:"id,omitempty"`
+	Name         string                      `json:"name,omitempty"`
+	Input        json.RawMessage             `json:"input,omitempty"`
+	ToolUseId    string                      `json:"tool_use_id,omitempty"`
+	Content      json.RawMessage             `json:"content,omitempty"`
+	IsError      bool                        `json:"is_error,omitempty"`
+	Title        string                      `json:"title,omitempty"`
+	Context      string                      `json:"context,omitempty"`
+	CacheControl *ClaudeCacheControl         `json:"cache_control,omitempty"`
+	// thinking / redacted_thinking sent back in assistant messages
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"`
+}
+
+// request.messages[].content[].source, image / document
+type ClaudeMessageContentSource struct {
+	Type      string `json:"type,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Url       string `json:"url,omitempty"`
+}
+
+// request.tool_choice
+type ClaudeMessageToolChoice struct {
+	Type                   string `json:"type,omitempty"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// request.thinking, type is enabled or disabled
+type ClaudeThinkingConfig struct {
+	Type         string `json:"type,omitempty"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// thinking is enabled by the request
+func (thinking *ClaudeThinkingConfig) IsEnabled() bool {
+	return thinking != nil && thinking.Type == "enabled"
+}
+
 // request.metadata
 type ClaudeMessageCompletionRequestMetadata struct {
 	UserId string `json:"user_id,omitempty"`
 }
 
-// request.tools.input_schema.properties
-type ClaudeMessageCompletionRequestPropertiesItem struct {
-	Type        string `json:"type,omitempty"`
-	Description string `json:"description,omitempty"`
+// request.tools[].cache_control, request.system[].cache_control, request.messages[].content[].cache_control
+type ClaudeCacheControl struct {
+	Type string `json:"type,omitempty"`
+	TTL  string `json:"ttl,omitempty"`
 }
 
-// request.tools.input_schema
-type ClaudeMessageCompletionRequestInputSchema struct {
-	Type       string                                                   `json:"type,omitempty"`
-	Properties map[string]*ClaudeMessageCompletionRequestPropertiesItem `json:"properties,omitempty"`
-	Required   []string                                                 `json:"required,omitempty"`
+// request.tools[].user_location, web search
+type ClaudeToolUserLocation struct {
+	Type     string `json:"type,omitempty"`
+	City     string `json:"city,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
 }
 
 // request.tools
 type ClaudeMessageCompletionRequestTools struct {
-	Type        string                                     `json:"type,omitempty"`
-	Name        string                                     `json:"name,omitempty"`
-	Description string                                     `json:"description,omitempty"`
-	InputSchema *ClaudeMessageCompletionRequestInputSchema `json:"input_schema,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	// json schema passed through as is
+	InputSchema  json.RawMessage     `json:"input_schema,omitempty"`
+	CacheControl *ClaudeCacheControl `json:"cache_control,omitempty"`
 	// add for computer use
-	DisplayHeightPx int `json:"display_height_px,omitempty"`
-	DisplayWidthPx  int `json:"display_width_px,omitempty"`
-	DisplayNumber   int `json:"display_number,omitempty"`
+	DisplayHeightPx int  `json:"display_height_px,omitempty"`
+	DisplayWidthPx  int  `json:"display_width_px,omitempty"`
+	DisplayNumber   int  `json:"display_number,omitempty"`
+	EnableZoom      bool `json:"enable_zoom,omitempty"`
+	// text editor
+	MaxCharacters int `json:"max_characters,omitempty"`
+	// web search / web fetch
+	MaxUses          int                     `json:"max_uses,omitempty"`
+	AllowedDomains   []string                `json:"allowed_domains,omitempty"`
+	BlockedDomains   []string                `json:"blocked_domains,omitempty"`
+	UserLocation     *ClaudeToolUserLocation `json:"user_location,omitempty"`
+	Citations        json.RawMessage         `json:"citations,omitempty"`
+	MaxContentTokens int                     `json:"max_content_tokens,omitempty"`
+	// fields unknown to the proxy, forwarded to bedrock
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (tool *ClaudeMessageCompletionRequestTools) UnmarshalJSON(data []byte) error {
+	type Alias ClaudeMessageCompletionRequestTools
+	err := json.Unmarshal(data, (*Alias)(tool))
+	if err != nil {
+		return err
+	}
+	tool.Extra, err = unknownFields(data, toolFieldNames)
+	return err
+}
+
+func (tool ClaudeMessageCompletionRequestTools) MarshalJSON() ([]byte, error) {
+	type Alias ClaudeMessageCompletionRequestTools
+	data, err := json.Marshal(Alias(tool))
+	if err != nil {
+		return nil, err
+	}
+	return withExtraFields(data, tool.Extra)
 }
 
 // request
 type ClaudeMessageCompletionRequest struct {
-	Temperature      float64                                  `json:"temperature,omitempty"`
+	Temperature      *float64                                 `json:"temperature,omitempty"`
 	StopSequences    []string                                 `json:"stop_sequences,omitempty"`
 	TopP             float64                                  `json:"top_p,omitempty"`
 	TopK             int                                      `json:"top_k,omitempty"`
@@ -420,6 +790,20 @@ type ClaudeMessageCompletionRequest struct {
 	Messages         []*ClaudeMessageCompletionRequestMessage `json:"messages,omitempty"`
 	Metadata         *ClaudeMessageCompletionRequestMetadata  `json:"-"`
 	Tools            []*ClaudeMessageCompletionRequestTools   `json:"tools,omitempty"`
+	ToolChoice       *ClaudeMessageToolChoice                 `json:"tool_choice,omitempty"`
+	Thinking         *ClaudeThinkingConfig                    `json:"thinking,omitempty"`
+	// fields unknown to the proxy, forwarded to bedrock
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// request with the unknown fields
+func (request ClaudeMessageCompletionRequest) MarshalJSON() ([]byte, error) {
+	type Alias ClaudeMessageCompletionRequest
+	data, err := json.Marshal(Alias(request))
+	if err != nil {
+		return nil, err
+	}
+	return withExtraFields(data, request.Extra)
 }
 
 // unused
@@ -456,6 +840,12 @@ func (request *ClaudeMessageCompletionRequest) UnmarshalJSON(data []byte) error
 	request.Stream = tmp.Stream
 	request.Model = tmp.Model
 
+	extra, err := unknownFields(data, requestFieldNames)
+	if err != nil {
+		return err
+	}
+	request.Extra = extra
+
 	//Log.Debug("ClaudeMessageCompletionRequest UnmarshalJSON")
 	//Log.Debug(tests.ToJSON(tmp))
 	//Log.Debugf("%+v", this)
@@ -488,12 +878,31 @@ type ClaudeMessageContentBlock struct {
 	Id    string      `json:"id,omitempty"`
 	Name  string      `json:"name,omitempty"`
 	Input interface{} `json:"input,omitempty"`
+	// thinking blocks, the signature must be sent back with the block on the next turn
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	// redacted_thinking blocks
+	Data string `json:"data,omitempty"`
 }
 
-// response.usage
+// response.usage, input_tokens does not include the tokens written to or read from cache
 type ClaudeMessageUsage struct {
-	InputTokens  int `json:"input_tokens,omitempty"`
-	OutputTokens int `json:"output_tokens,omitempty"`
+	InputTokens              int                  `json:"input_tokens,omitempty"`
+	OutputTokens             int                  `json:"output_tokens,omitempty"`
+	CacheCreationInputTokens int                  `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int                  `json:"cache_read_input_tokens"`
+	CacheCreation            *ClaudeCacheCreation `json:"cache_creation,omitempty"`
+}
+
+// response.usage.cache_creation, tokens written to cache by ttl
+type ClaudeCacheCreation struct {
+	Ephemeral5mInputTokens int `json:"ephemeral_5m_input_tokens"`
+	Ephemeral1hInputTokens int `json:"ephemeral_1h_input_tokens"`
+}
+
+// all input tokens of the request, including cached ones
+func (usage *ClaudeMessageUsage) TotalInputTokens() int {
+	return usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens
 }
 
 // response
@@ -506,6 +915,8 @@ type ClaudeMessageCompletionResponse struct {
 	Role    string                       `json:"role,omitempty"`
 	Content []*ClaudeMessageContentBlock `json:"content,omitempty"`
 	Usage   *ClaudeMessageUsage          `json:"usage,omitempty"`
+	// guardrail trace of converse backend
+	Trace interface{} `json:"amazon-bedrock-trace,omitempty"`
 }
 
 // sse
@@ -515,6 +926,9 @@ type ClaudeMessageDelta struct {
 	Type        string `json:"type,omitempty"`
 	Text        string `json:"text,omitempty"`
 	PartialJson string `json:"partial_json,omitempty"`
+	// thinking_delta / signature_delta
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
 }
 
 type ClaudeMessageCompletionStreamEvent struct {
@@ -576,79 +990,51 @@ func (response *MessageCompleteResponse) GetEvents() <-chan ISSEDecoder {
 	return response.Events
 }
 
-func (client *BedrockClient) MessageCompletion(req *ClaudeMessageCompletionRequest) (IStreamableResponse, error) {
-	modelId := req.Model
-	mappedModel, exist := client.config.ModelMappings[modelId]
-	if exist {
-		modelId = mappedModel
-	}
-	if len(modelId) == 0 {
-		modelId = client.config.AnthropicDefaultModel
-	}
-	apiVersion, exist := client.config.AnthropicVersionMappings[req.AnthropicVersion]
-	if exist {
-		req.AnthropicVersion = apiVersion
-	}
-	if len(req.AnthropicVersion) == 0 {
-		req.AnthropicVersion = client.config.AnthropicDefaultVersion
+// call one model of the chain of req.Model
+func (client *BedrockClient) messageCompletion(ctx context.Context, req *ClaudeMessageCompletionRequest, modelId string) (IStreamableResponse, error) {
+	if client.config.GetBackend(req.Model, modelId) == BackendConverse {
+		return client.converseCompletion(ctx, req, modelId)
 	}
+	req.AnthropicVersion = client.config.GetAnthropicVersion(req.AnthropicVersion)
 
-	body, err := json.Marshal(req)
+	body, err := json.Marshal(client.config.filterRequestFields(req))
 	if err != nil {
 		Log.Errorf("Couldn't marshal the request: ", err)
 		return nil, err
 	}
 
-	Log.Debugf("Request: %s", string(body))
-	Log.Debugf("Request Model ID: %s", modelId)
+	// request body holds the prompt, it is not logged
+	Log.Debugf("Request Model ID: %s, %d bytes", modelId, len(body))
+
+	ctx, cancel := client.upstreamContext(ctx, req.Model, modelId)
 
 	if req.Stream {
-		output, err := client.client.InvokeModelWithResponseStream(context.Background(), &bedrock.InvokeModelWithResponseStreamInput{
+		output, err := client.client.InvokeModelWithResponseStream(ctx, &bedrock.InvokeModelWithResponseStreamInput{
 			Body:        body,
 			ModelId:     aws.String(modelId),
 			ContentType: aws.String("application/json"),
 		})
 		if err != nil {
+			cancel()
 			Log.Error(err)
 			return nil, err
 		}
 
-		reader := output.GetStream()
-		eventQueue := make(chan ISSEDecoder, 10)
-
-		go func() {
-			defer reader.Close()
-			defer close(eventQueue)
-
-			for event := range reader.Events() {
-				switch v := event.(type) {
-				case *types.ResponseStreamMemberChunk:
-
-					Log.Debug("payload", string(v.Value.Bytes))
-
-					var resp ClaudeMessageCompletionStreamEvent
-					err := json.NewDecoder(bytes.NewReader(v.Value.Bytes)).Decode(&resp)
-					if err != nil {
-						Log.Error(err)
-						continue
-					}
-					resp.Raw = v.Value.Bytes
-					eventQueue <- &resp
-
-				case *types.UnknownUnionMember:
-					Log.Errorf("unknown tag:", v.Tag)
-					continue
-				default:
-					Log.Errorf("union is nil or unknown type")
-					continue
-				}
+		eventQueue := PumpBedrockStream(ctx, output.GetStream(), func(payload []byte) (ISSEDecoder, error) {
+			var resp ClaudeMessageCompletionStreamEvent
+			err := json.NewDecoder(bytes.NewReader(payload)).Decode(&resp)
+			if err != nil {
+				return nil, err
 			}
-		}()
+			resp.Raw = payload
+			return &resp, nil
+		}, cancel)
 
 		return NewStreamMessageCompleteResponse(eventQueue), nil
 	}
 
-	output, err := client.client.InvokeModel(context.Background(), &bedrock.InvokeModelInput{
+	defer cancel()
+	output, err := client.client.InvokeModel(ctx, &bedrock.InvokeModelInput{
 		Body:        body,
 		ModelId:     aws.String(modelId),
 		ContentType: aws.String("application/json"),
@@ -672,3 +1058,77 @@ func (client *BedrockClient) MessageCompletion(req *ClaudeMessageCompletionReque
 
 	return nil, nil
 }
+
+// ---------------------
+// count tokens api
+// ---------------------
+// response
+type ClaudeMessageCountTokensResponse struct {
+	InputTokens int `json:"input_tokens"`
+}
+
+// count input tokens with bedrock CountTokens,
+// fallback to invoke with max_tokens 1 and read the usage if CountTokens is not available
+func (client *BedrockClient) CountTokens(ctx context.Context, req *ClaudeMessageCompletionRequest) (*ClaudeMessageCountTokensResponse, error) {
+	modelId := client.config.GetModelId(req.Model)
+	req.AnthropicVersion = client.config.GetAnthropicVersion(req.AnthropicVersion)
+	req.Stream = false
+	// token-counting beta is only a flag of the anthropic api, bedrock rejects it
+	betas := []string{}
+	for _, beta := range req.AnthropicBeta {
+		if !strings.HasPrefix(beta, "token-counting") {
+			betas = append(betas, beta)
+		}
+	}
+	req.AnthropicBeta = betas
+	// max_tokens is required in body but not in count_tokens request
+	if req.MaxToken <= 0 {
+		req.MaxToken = 1
+	}
+
+	body, err := json.Marshal(client.config.filterRequestFields(req))
+	if err != nil {
+		Log.Errorf("Couldn't marshal the request: %v", err)
+		return nil, err
+	}
+
+	// the anthropic body is only accepted by anthropic models
+	if GetModelFamily(modelId).IsAnthropic() {
+		countCtx, cancel := client.upstreamContext(ctx, req.Model, modelId)
+		output, err := client.client.CountTokens(countCtx, &bedrock.CountTokensInput{
+			// CountTokens takes foundation models only
+			ModelId: aws.String(FoundationModelId(modelId)),
+			Input: &types.CountTokensInputMemberInvokeModel{
+				Value: types.InvokeModelTokensRequest{Body: body},
+			},
+		})
+		cancel()
+		if err == nil {
+			return &ClaudeMessageCountTokensResponse{
+				InputTokens: int(aws.ToInt32(output.InputTokens)),
+			}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		Log.Warningf("CountTokens is not available for %s, fallback to invoke, %v", modelId, err)
+	}
+
+	// thinking needs a budget below max_tokens, it is not part of the input anyway
+	req.MaxToken = 1
+	req.Thinking = nil
+	response, err := client.MessageCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, fmt.Errorf("empty response of %s", modelId)
+	}
+	resp, ok := response.GetResponse().(*ClaudeMessageCompletionResponse)
+	if !ok || resp == nil || resp.Usage == nil {
+		return nil, fmt.Errorf("no usage in response of %s", modelId)
+	}
+	return &ClaudeMessageCountTokensResponse{
+		InputTokens: resp.Usage.TotalInputTokens(),
+	}, nil
+}
@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ---------------------
+// text completion via messages api
+// ---------------------
+// turn markers of text completion prompts
+const (
+	humanPrompt     = "\n\nHuman:"
+	assistantPrompt = "\n\nAssistant:"
+)
+
+// only claude 2 and claude instant accept text completions, newer models need messages
+func SupportsTextCompletion(modelId string) bool {
+	return strings.Contains(modelId, "anthropic.claude-v2") || strings.Contains(modelId, "anthropic.claude-instant")
+}
+
+// convert \n\nHuman: / \n\nAssistant: prompt to message request,
+// text before the first turn becomes the system prompt
+func (request *ClaudeTextCompletionRequest) ToMessageRequest() (*ClaudeMessageCompletionRequest, error) {
+	req := &ClaudeMessageCompletionRequest{
+		Model:         request.Model,
+		Stream:        request.Stream,
+		MaxToken:      request.MaxTokensToSample,
+		Temperature:   request.Temperature,
+		TopP:          request.TopP,
+		TopK:          request.TopK,
+		StopSequences: request.StopSequences,
+	}
+
+	prompt := request.Prompt
+	role := ""
+	for len(prompt) > 0 {
+		// next turn marker
+		humanIndex := strings.Index(prompt, humanPrompt)
+		assistantIndex := strings.Index(prompt, assistantPrompt)
+		next, nextRole, marker := len(prompt), "", ""
+		if humanIndex >= 0 && (assistantIndex < 0 || humanIndex < assistantIndex) {
+			next, nextRole, marker = humanIndex, "user", humanPrompt
+		} else if assistantIndex >= 0 {
+			next, nextRole, marker = assistantIndex, "assistant", assistantPrompt
+		}
+
+		text := strings.TrimSpace(prompt[:next])
+		if len(role) == 0 {
+			if len(text) > 0 {
+				req.System, _ = json.Marshal(text)
+			}
+		} else if len(text) > 0 {
+			appendClaudeMessage(req, role, []*ClaudeMessageRequestContent{{Type: "text", Text: text}})
+		}
+
+		if len(nextRole) == 0 {
+			break
+		}
+		role = nextRole
+		prompt = prompt[next+len(marker):]
+	}
+
+	if len(req.Messages) == 0 || req.Messages[0].Role != "user" {
+		return nil, NewInvalidRequestError(fmt.Errorf("prompt must start with %q", humanPrompt))
+	}
+	return req, nil
+}
+
+// messages stop_reason => text completion stop_reason and stop
+func textCompletionStop(stopReason string, stopSequence string) (string, string) {
+	switch stopReason {
+	case "max_tokens":
+		return "max_tokens", ""
+	case "stop_sequence":
+		return "stop_sequence", stopSequence
+	}
+	// the text completion api reports the end of turn as reaching \n\nHuman:
+	return "stop_sequence", humanPrompt
+}
+
+// completion_xxx of message id msg_xxx
+func newCompletionId(messageId string) string {
+	return "compl_" + strings.TrimPrefix(messageId, "msg_")
+}
+
+// convert message response to text completion response
+func NewTextCompletionResponse(model string, resp *ClaudeMessageCompletionResponse) *ClaudeTextCompletionResponse {
+	completion := ""
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			completion += block.Text
+		}
+	}
+	stopReason, stop := textCompletionStop(resp.StopReason, resp.StopSequence)
+	return &ClaudeTextCompletionResponse{
+		Type:       "completion",
+		Id:         newCompletionId(resp.Id),
+		Completion: completion,
+		StopReason: stopReason,
+		Stop:       stop,
+		Model:      model,
+	}
+}
+
+// convert message stream events to text completion events
+func NewTextCompletionStream(ctx context.Context, model string, queue <-chan ISSEDecoder) <-chan ISSEDecoder {
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+
+	go func() {
+		defer close(eventQueue)
+
+		id := ""
+		for event := range queue {
+			var completionEvent ISSEDecoder
+			switch v := event.(type) {
+			case *SSEErrorEvent:
+				completionEvent = v
+			case *ClaudeMessageCompletionStreamEvent:
+				resp := &ClaudeTextCompletionStreamEvent{Type: "completion", Id: id, Model: model}
+				switch v.Type {
+				case "message_start":
+					if v.Message != nil {
+						id = newCompletionId(v.Message.Id)
+					}
+					continue
+				case "content_block_delta":
+					if v.Delta == nil || v.Delta.Type != "text_delta" {
+						continue
+					}
+					resp.Completion = v.Delta.Text
+				case "message_delta":
+					if v.Delta == nil || len(v.Delta.StopReason) == 0 {
+						continue
+					}
+					resp.StopReason, resp.Stop = textCompletionStop(v.Delta.StopReason, v.Delta.StopSequence)
+				default:
+					continue
+				}
+				resp.Raw, _ = json.Marshal(resp)
+				completionEvent = resp
+			default:
+				continue
+			}
+
+			select {
+			case eventQueue <- completionEvent:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return eventQueue
+}
+
+// serve text completion request with messages api
+func (client *BedrockClient) completeTextWithMessages(ctx context.Context, request *ClaudeTextCompletionRequest) (IStreamableResponse, error) {
+	req, err := request.ToMessageRequest()
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.MessageCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if response == nil {
+		return nil, fmt.Errorf("empty response from bedrock")
+	}
+
+	if response.IsStream() {
+		return NewStreamCompleteTextResponse(NewTextCompletionStream(ctx, request.Model, response.GetEvents())), nil
+	}
+
+	resp, ok := response.GetResponse().(*ClaudeMessageCompletionResponse)
+	if !ok || resp == nil {
+		return nil, fmt.Errorf("empty response from bedrock")
+	}
+	return NewCompleteTextResponse(NewTextCompletionResponse(request.Model, resp)), nil
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"os"
+	"strconv"
 )
 
 type Config struct {
 	HttpConfig
 	BedrockConfig *BedrockConfig `json:"bedrock_config,omitempty"`
+	BatchConfig   *BatchConfig   `json:"batch_config,omitempty"`
 }
 
 func NewConfigFromLocal(filename string) (*Config, error) {
@@ -33,16 +35,33 @@ func (config *Config) MarginWithENV() {
 		config.APIKey = apiKey
 	}
 
+	pingInterval, err := strconv.Atoi(os.Getenv("SSE_PING_INTERVAL"))
+	if err == nil {
+		config.PingInterval = pingInterval
+	}
+
 	envBedrockConfig := LoadBedrockConfigWithEnv()
 	if config.BedrockConfig == nil {
 		config.BedrockConfig = envBedrockConfig
 	} else {
+		if envBedrockConfig.CredentialMode != "" {
+			config.BedrockConfig.CredentialMode = envBedrockConfig.CredentialMode
+		}
 		if envBedrockConfig.AccessKey != "" {
 			config.BedrockConfig.AccessKey = envBedrockConfig.AccessKey
 		}
 		if envBedrockConfig.SecretKey != "" {
 			config.BedrockConfig.SecretKey = envBedrockConfig.SecretKey
 		}
+		if envBedrockConfig.Profile != "" {
+			config.BedrockConfig.Profile = envBedrockConfig.Profile
+		}
+		if envBedrockConfig.WebIdentityRoleArn != "" {
+			config.BedrockConfig.WebIdentityRoleArn = envBedrockConfig.WebIdentityRoleArn
+		}
+		if envBedrockConfig.WebIdentityTokenFile != "" {
+			config.BedrockConfig.WebIdentityTokenFile = envBedrockConfig.WebIdentityTokenFile
+		}
 		if envBedrockConfig.Region != "" {
 			config.BedrockConfig.Region = envBedrockConfig.Region
 		}
@@ -52,9 +71,39 @@ func (config *Config) MarginWithENV() {
 		if envBedrockConfig.RoleRegion != "" {
 			config.BedrockConfig.RoleRegion = envBedrockConfig.RoleRegion
 		}
+		if envBedrockConfig.RoleExternalId != "" {
+			config.BedrockConfig.RoleExternalId = envBedrockConfig.RoleExternalId
+		}
+		if envBedrockConfig.RoleSessionName != "" {
+			config.BedrockConfig.RoleSessionName = envBedrockConfig.RoleSessionName
+		}
+		if envBedrockConfig.RoleDurationSeconds > 0 {
+			config.BedrockConfig.RoleDurationSeconds = envBedrockConfig.RoleDurationSeconds
+		}
+		if len(envBedrockConfig.RoleSessionTags) > 0 {
+			config.BedrockConfig.RoleSessionTags = envBedrockConfig.RoleSessionTags
+		}
+		if len(envBedrockConfig.RoleChain) > 0 {
+			config.BedrockConfig.RoleChain = envBedrockConfig.RoleChain
+		}
 		if len(envBedrockConfig.ModelMappings) > 0 {
 			config.BedrockConfig.ModelMappings = envBedrockConfig.ModelMappings
 		}
+		if len(envBedrockConfig.FallbackOn) > 0 {
+			config.BedrockConfig.FallbackOn = envBedrockConfig.FallbackOn
+		}
+		if envBedrockConfig.InferenceProfilePrefix != "" {
+			config.BedrockConfig.InferenceProfilePrefix = envBedrockConfig.InferenceProfilePrefix
+		}
+		if envBedrockConfig.DiscoverInferenceProfiles {
+			config.BedrockConfig.DiscoverInferenceProfiles = true
+		}
+		if len(envBedrockConfig.ForwardFields) > 0 {
+			config.BedrockConfig.ForwardFields = envBedrockConfig.ForwardFields
+		}
+		if len(envBedrockConfig.DropFields) > 0 {
+			config.BedrockConfig.DropFields = envBedrockConfig.DropFields
+		}
 		if len(envBedrockConfig.AnthropicVersionMappings) > 0 {
 			config.BedrockConfig.AnthropicVersionMappings = envBedrockConfig.AnthropicVersionMappings
 		}
@@ -64,6 +113,48 @@ func (config *Config) MarginWithENV() {
 		if envBedrockConfig.AnthropicDefaultVersion != "" {
 			config.BedrockConfig.AnthropicDefaultVersion = envBedrockConfig.AnthropicDefaultVersion
 		}
+		if envBedrockConfig.UpstreamTimeout > 0 {
+			config.BedrockConfig.UpstreamTimeout = envBedrockConfig.UpstreamTimeout
+		}
+		if len(envBedrockConfig.ModelTimeouts) > 0 {
+			config.BedrockConfig.ModelTimeouts = envBedrockConfig.ModelTimeouts
+		}
+		if envBedrockConfig.DefaultBackend != "" {
+			config.BedrockConfig.DefaultBackend = envBedrockConfig.DefaultBackend
+		}
+		if len(envBedrockConfig.ModelBackends) > 0 {
+			config.BedrockConfig.ModelBackends = envBedrockConfig.ModelBackends
+		}
+		if envBedrockConfig.Guardrail != nil {
+			config.BedrockConfig.Guardrail = envBedrockConfig.Guardrail
+		}
+		if len(envBedrockConfig.Targets) > 0 {
+			config.BedrockConfig.Targets = envBedrockConfig.Targets
+		}
+		if envBedrockConfig.Routing != "" {
+			config.BedrockConfig.Routing = envBedrockConfig.Routing
+		}
+		if envBedrockConfig.CircuitBreaker != nil {
+			config.BedrockConfig.CircuitBreaker = envBedrockConfig.CircuitBreaker
+		}
+		if envBedrockConfig.Retry != nil {
+			config.BedrockConfig.Retry = envBedrockConfig.Retry
+		}
+	}
+
+	envBatchConfig := LoadBatchConfigWithEnv()
+	if config.BatchConfig == nil {
+		config.BatchConfig = envBatchConfig
+	} else {
+		if envBatchConfig.DataDir != "" {
+			config.BatchConfig.DataDir = envBatchConfig.DataDir
+		}
+		if envBatchConfig.Workers > 0 {
+			config.BatchConfig.Workers = envBatchConfig.Workers
+		}
+		if envBatchConfig.RequestsPerMinute != 0 {
+			config.BatchConfig.RequestsPerMinute = envBatchConfig.RequestsPerMinute
+		}
 	}
 }
 
@@ -0,0 +1,941 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	bedrock "github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// ---------------------
+// converse backend
+// ---------------------
+// bedrock apis used to call a model
+const (
+	// InvokeModel / InvokeModelWithResponseStream with anthropic json body
+	BackendInvoke = "invoke"
+	// Converse / ConverseStream
+	BackendConverse = "converse"
+)
+
+// guardrail applied by the converse backend
+type GuardrailConfig struct {
+	Identifier string `json:"identifier"`
+	Version    string `json:"version,omitempty"`
+	// enabled, enabled_full or disabled
+	Trace string `json:"trace,omitempty"`
+	// sync or async, streaming only
+	StreamProcessingMode string `json:"stream_processing_mode,omitempty"`
+}
+
+// backend of model, model_backends by alias or model id first, then default_backend.
+// non-anthropic models are always called with converse
+func (config *BedrockConfig) GetBackend(model string, modelId string) string {
+	if !GetModelFamily(modelId).IsAnthropic() {
+		return BackendConverse
+	}
+	for _, key := range []string{model, modelId, FoundationModelId(modelId)} {
+		backend, exist := config.ModelBackends[key]
+		if exist && len(backend) > 0 {
+			return backend
+		}
+	}
+	if len(config.DefaultBackend) > 0 {
+		return config.DefaultBackend
+	}
+	return BackendInvoke
+}
+
+// guardrail version, DRAFT if not set
+func (guardrail *GuardrailConfig) GetVersion() string {
+	if len(guardrail.Version) > 0 {
+		return guardrail.Version
+	}
+	return "DRAFT"
+}
+
+// event stream of ConverseStream,
+// implemented by *bedrockruntime.ConverseStreamEventStream
+type IConverseEventStream interface {
+	Events() <-chan types.ConverseStreamOutput
+	Close() error
+	Err() error
+}
+
+// msg_bdrk_xxx, converse does not return message ids
+func newMessageId() string {
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	return "msg_bdrk_" + hex.EncodeToString(raw)
+}
+
+// the converse input shared by Converse and ConverseStream
+type converseRequest struct {
+	System                            []types.SystemContentBlock
+	Messages                          []types.Message
+	InferenceConfig                   *types.InferenceConfiguration
+	ToolConfig                        *types.ToolConfiguration
+	AdditionalModelRequestFields      document.Interface
+	AdditionalModelResponseFieldPaths []string
+	RequestMetadata                   map[string]string
+}
+
+// convert anthropic message request to converse input
+func newConverseRequest(ctx context.Context, req *ClaudeMessageCompletionRequest, modelId string) (*converseRequest, error) {
+	family := GetModelFamily(modelId)
+	result := &converseRequest{
+		InferenceConfig: &types.InferenceConfiguration{
+			MaxTokens: aws.Int32(int32(req.MaxToken)),
+		},
+	}
+	if len(req.StopSequences) > 0 {
+		if family.StopSequences {
+			result.InferenceConfig.StopSequences = req.StopSequences
+		} else {
+			Log.Debugf("stop_sequences is not supported by %s, ignored", modelId)
+		}
+	}
+	if req.Temperature != nil {
+		result.InferenceConfig.Temperature = aws.Float32(float32(*req.Temperature))
+	}
+	if req.TopP > 0 {
+		result.InferenceConfig.TopP = aws.Float32(float32(req.TopP))
+	}
+	if req.Metadata != nil && len(req.Metadata.UserId) > 0 {
+		result.RequestMetadata = map[string]string{"user_id": req.Metadata.UserId}
+	}
+
+	// model specific fields
+	additional := map[string]interface{}{}
+	if req.TopK > 0 {
+		for key, value := range family.TopKFields(req.TopK) {
+			additional[key] = value
+		}
+	}
+	if family.IsAnthropic() {
+		if len(req.AnthropicBeta) > 0 {
+			additional["anthropic_beta"] = req.AnthropicBeta
+		}
+		// converse has no thinking config, claude reads it from the model fields
+		if req.Thinking != nil {
+			additional["thinking"] = req.Thinking
+		}
+		result.AdditionalModelResponseFieldPaths = []string{"/stop_sequence"}
+	}
+	if len(additional) > 0 {
+		result.AdditionalModelRequestFields = document.NewLazyDocument(additional)
+	}
+
+	system, err := converseSystem(req.System, family)
+	if err != nil {
+		return nil, err
+	}
+	// models without system prompt get it at the head of the first user message
+	var systemPrefix []types.ContentBlock
+	if len(system) > 0 && !family.System {
+		for _, block := range system {
+			if text, ok := block.(*types.SystemContentBlockMemberText); ok {
+				systemPrefix = append(systemPrefix, &types.ContentBlockMemberText{Value: text.Value})
+			}
+		}
+		system = nil
+	}
+	result.System = system
+
+	converter := &converseContentConverter{ctx: ctx, family: family}
+	for _, message := range req.Messages {
+		blocks, err := parseMessageContent(message.Content)
+		if err != nil {
+			return nil, err
+		}
+		content, err := converter.contentBlocks(blocks)
+		if err != nil {
+			return nil, err
+		}
+		if message.Role == "user" && len(systemPrefix) > 0 {
+			content = append(systemPrefix, content...)
+			systemPrefix = nil
+		}
+		result.Messages = append(result.Messages, types.Message{
+			Role:    types.ConversationRole(message.Role),
+			Content: content,
+		})
+	}
+
+	toolConfig, err := converseToolConfig(req, family, result.Messages)
+	if err != nil {
+		return nil, err
+	}
+	result.ToolConfig = toolConfig
+
+	return result, nil
+}
+
+// content is a string or an array of blocks
+func parseMessageContent(raw json.RawMessage) ([]*ClaudeMessageRequestContent, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []*ClaudeMessageRequestContent{{Type: "text", Text: text}}, nil
+	}
+	var blocks []*ClaudeMessageRequestContent
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid message content, %v", err))
+	}
+	return blocks, nil
+}
+
+// system is a string or an array of text blocks
+func converseSystem(raw json.RawMessage, family *ModelFamily) ([]types.SystemContentBlock, error) {
+	blocks, err := parseMessageContent(raw)
+	if err != nil {
+		return nil, err
+	}
+	system := []types.SystemContentBlock{}
+	for _, block := range blocks {
+		if block.Type != "text" {
+			return nil, NewInvalidRequestError(fmt.Errorf("unsupported system content type: %s", block.Type))
+		}
+		system = append(system, &types.SystemContentBlockMemberText{Value: block.Text})
+		if cachePoint := family.ConverseCachePoint(block.CacheControl); cachePoint != nil {
+			system = append(system, &types.SystemContentBlockMemberCachePoint{Value: *cachePoint})
+		}
+	}
+	return system, nil
+}
+
+// tools and tool_choice
+func converseToolConfig(req *ClaudeMessageCompletionRequest, family *ModelFamily, messages []types.Message) (*types.ToolConfiguration, error) {
+	if len(req.Tools) == 0 {
+		return nil, nil
+	}
+	// converse has no tool_choice none, the tools are left out so no tool can be called.
+	// the tools are still needed for tool_use blocks in history, then none can not be honoured
+	if req.ToolChoice != nil && req.ToolChoice.Type == "none" {
+		if hasToolBlocks(messages) {
+			return nil, NewInvalidRequestError(fmt.Errorf("tool_choice none is not supported by the converse backend with tool_use blocks in messages"))
+		}
+		return nil, nil
+	}
+	if req.ToolChoice != nil && req.ToolChoice.DisableParallelToolUse {
+		return nil, NewInvalidRequestError(fmt.Errorf("disable_parallel_tool_use is not supported by the converse backend"))
+	}
+	if !family.Tools {
+		return nil, NewInvalidRequestError(fmt.Errorf("tools are not supported by %s models", family.Name))
+	}
+	toolConfig := &types.ToolConfiguration{}
+	for _, tool := range req.Tools {
+		// computer use and other anthropic defined tools have no converse tool spec
+		if len(tool.Type) > 0 && tool.Type != "custom" {
+			return nil, NewInvalidRequestError(fmt.Errorf("tool type %s is not supported by the converse backend", tool.Type))
+		}
+		schema := tool.InputSchema
+		if len(schema) == 0 {
+			schema = emptyInputSchema
+		}
+		schemaDocument, err := newLazyDocument(schema)
+		if err != nil {
+			return nil, err
+		}
+		spec := types.ToolSpecification{
+			Name:        aws.String(tool.Name),
+			InputSchema: &types.ToolInputSchemaMemberJson{Value: schemaDocument},
+		}
+		if len(tool.Description) > 0 {
+			spec.Description = aws.String(tool.Description)
+		}
+		toolConfig.Tools = append(toolConfig.Tools, &types.ToolMemberToolSpec{Value: spec})
+		if cachePoint := family.ConverseCachePoint(tool.CacheControl); cachePoint != nil {
+			toolConfig.Tools = append(toolConfig.Tools, &types.ToolMemberCachePoint{Value: *cachePoint})
+		}
+	}
+
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto":
+			toolConfig.ToolChoice = &types.ToolChoiceMemberAuto{}
+		case "any":
+			toolConfig.ToolChoice = &types.ToolChoiceMemberAny{}
+		case "tool":
+			toolConfig.ToolChoice = &types.ToolChoiceMemberTool{Value: types.SpecificToolChoice{Name: aws.String(req.ToolChoice.Name)}}
+		default:
+			return nil, NewInvalidRequestError(fmt.Errorf("tool_choice %s is not supported by the converse backend", req.ToolChoice.Type))
+		}
+	}
+	return toolConfig, nil
+}
+
+// messages have tool_use or tool_result blocks
+func hasToolBlocks(messages []types.Message) bool {
+	for _, message := range messages {
+		for _, block := range message.Content {
+			switch block.(type) {
+			case *types.ContentBlockMemberToolUse, *types.ContentBlockMemberToolResult:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cache point following a block with cache_control, nil if none or not supported by family.
+// converse cache points have no ttl, the default 5 minutes apply
+func (family *ModelFamily) ConverseCachePoint(cacheControl *ClaudeCacheControl) *types.CachePointBlock {
+	if cacheControl == nil {
+		return nil
+	}
+	if !family.CachePoints {
+		Log.Debugf("prompt caching is not supported by %s models, cache_control ignored", family.Name)
+		return nil
+	}
+	if len(cacheControl.TTL) > 0 && cacheControl.TTL != "5m" {
+		Log.Debugf("cache ttl %s is not supported by the converse backend, ignored", cacheControl.TTL)
+	}
+	return &types.CachePointBlock{Type: types.CachePointTypeDefault}
+}
+
+// json to smithy document
+func newLazyDocument(raw json.RawMessage) (document.Interface, error) {
+	var value interface{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, NewInvalidRequestError(err)
+		}
+	}
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+	return document.NewLazyDocument(value), nil
+}
+
+// smithy document to json
+func documentToJSON(doc document.Interface) json.RawMessage {
+	if doc == nil {
+		return json.RawMessage("{}")
+	}
+	raw, err := doc.MarshalSmithyDocument()
+	if err != nil {
+		Log.Errorf("unable to marshal document, %v", err)
+		return json.RawMessage("{}")
+	}
+	return raw
+}
+
+// converts anthropic content blocks, documents need unique names in one request
+type converseContentConverter struct {
+	ctx       context.Context
+	family    *ModelFamily
+	documents int
+}
+
+func (converter *converseContentConverter) contentBlocks(blocks []*ClaudeMessageRequestContent) ([]types.ContentBlock, error) {
+	content := []types.ContentBlock{}
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			content = append(content, &types.ContentBlockMemberText{Value: block.Text})
+		case "image":
+			image, err := converter.image(block.Source)
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, &types.ContentBlockMemberImage{Value: *image})
+		case "document":
+			doc, err := converter.document(block)
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, &types.ContentBlockMemberDocument{Value: *doc})
+		case "tool_use":
+			input, err := newLazyDocument(block.Input)
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, &types.ContentBlockMemberToolUse{Value: types.ToolUseBlock{
+				ToolUseId: aws.String(block.Id),
+				Name:      aws.String(block.Name),
+				Input:     input,
+			}})
+		case "tool_result":
+			result, err := converter.toolResult(block)
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, &types.ContentBlockMemberToolResult{Value: *result})
+		case "thinking":
+			content = append(content, &types.ContentBlockMemberReasoningContent{
+				Value: &types.ReasoningContentBlockMemberReasoningText{Value: types.ReasoningTextBlock{
+					Text:      aws.String(block.Thinking),
+					Signature: aws.String(block.Signature),
+				}},
+			})
+		case "redacted_thinking":
+			content = append(content, &types.ContentBlockMemberReasoningContent{
+				Value: &types.ReasoningContentBlockMemberRedactedContent{Value: redactedContent(block.Data)},
+			})
+		default:
+			return nil, NewInvalidRequestError(fmt.Errorf("content type %s is not supported by the converse backend", block.Type))
+		}
+		if cachePoint := converter.family.ConverseCachePoint(block.CacheControl); cachePoint != nil {
+			content = append(content, &types.ContentBlockMemberCachePoint{Value: *cachePoint})
+		}
+	}
+	return content, nil
+}
+
+func (converter *converseContentConverter) toolResult(block *ClaudeMessageRequestContent) (*types.ToolResultBlock, error) {
+	result := &types.ToolResultBlock{
+		ToolUseId: aws.String(block.ToolUseId),
+		Status:    types.ToolResultStatusSuccess,
+		Content:   []types.ToolResultContentBlock{},
+	}
+	if block.IsError {
+		result.Status = types.ToolResultStatusError
+	}
+	blocks, err := parseMessageContent(block.Content)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range blocks {
+		switch item.Type {
+		case "text":
+			result.Content = append(result.Content, &types.ToolResultContentBlockMemberText{Value: item.Text})
+		case "image":
+			image, err := converter.image(item.Source)
+			if err != nil {
+				return nil, err
+			}
+			result.Content = append(result.Content, &types.ToolResultContentBlockMemberImage{Value: *image})
+		case "document":
+			doc, err := converter.document(item)
+			if err != nil {
+				return nil, err
+			}
+			result.Content = append(result.Content, &types.ToolResultContentBlockMemberDocument{Value: *doc})
+		default:
+			return nil, NewInvalidRequestError(fmt.Errorf("tool_result content type %s is not supported by the converse backend", item.Type))
+		}
+	}
+	return result, nil
+}
+
+// image/png => png
+var converseImageFormats = map[string]types.ImageFormat{
+	"image/png":  types.ImageFormatPng,
+	"image/jpeg": types.ImageFormatJpeg,
+	"image/gif":  types.ImageFormatGif,
+	"image/webp": types.ImageFormatWebp,
+}
+
+func (converter *converseContentConverter) image(source *ClaudeMessageContentSource) (*types.ImageBlock, error) {
+	if source == nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("image source is required"))
+	}
+	if source.Type == "url" {
+		var err error
+		source, err = loadImageSource(converter.ctx, source.Url)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if source.Type != "base64" {
+		return nil, NewInvalidRequestError(fmt.Errorf("image source type %s is not supported", source.Type))
+	}
+	format, exist := converseImageFormats[source.MediaType]
+	if !exist {
+		return nil, NewInvalidRequestError(fmt.Errorf("image media type %s is not supported", source.MediaType))
+	}
+	data, err := base64.StdEncoding.DecodeString(source.Data)
+	if err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid image data, %v", err))
+	}
+	return &types.ImageBlock{
+		Format: format,
+		Source: &types.ImageSourceMemberBytes{Value: data},
+	}, nil
+}
+
+// application/pdf => pdf
+var converseDocumentFormats = map[string]types.DocumentFormat{
+	"application/pdf":    types.DocumentFormatPdf,
+	"text/plain":         types.DocumentFormatTxt,
+	"text/csv":           types.DocumentFormatCsv,
+	"text/html":          types.DocumentFormatHtml,
+	"text/markdown":      types.DocumentFormatMd,
+	"application/msword": types.DocumentFormatDoc,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": types.DocumentFormatDocx,
+	"application/vnd.ms-excel": types.DocumentFormatXls,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": types.DocumentFormatXlsx,
+}
+
+// characters not allowed in converse document names
+var documentNameRegexp = regexp.MustCompile(`[^A-Za-z0-9\-()\[\] ]+|\s{2,}`)
+
+func (converter *converseContentConverter) document(block *ClaudeMessageRequestContent) (*types.DocumentBlock, error) {
+	source := block.Source
+	if source == nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("document source is required"))
+	}
+	var data []byte
+	switch source.Type {
+	case "base64":
+		var err error
+		data, err = base64.StdEncoding.DecodeString(source.Data)
+		if err != nil {
+			return nil, NewInvalidRequestError(fmt.Errorf("invalid document data, %v", err))
+		}
+	case "text":
+		data = []byte(source.Data)
+	default:
+		return nil, NewInvalidRequestError(fmt.Errorf("document source type %s is not supported by the converse backend", source.Type))
+	}
+	format, exist := converseDocumentFormats[source.MediaType]
+	if !exist {
+		return nil, NewInvalidRequestError(fmt.Errorf("document media type %s is not supported", source.MediaType))
+	}
+
+	converter.documents++
+	name := strings.TrimSpace(documentNameRegexp.ReplaceAllString(block.Title, " "))
+	if len(name) == 0 {
+		name = fmt.Sprintf("document-%d", converter.documents)
+	}
+	doc := &types.DocumentBlock{
+		Name:   aws.String(name),
+		Format: format,
+		Source: &types.DocumentSourceMemberBytes{Value: data},
+	}
+	if len(block.Context) > 0 {
+		doc.Context = aws.String(block.Context)
+	}
+	return doc, nil
+}
+
+// data of redacted_thinking is the base64 of the converse redacted content
+func redactedContent(data string) []byte {
+	content, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return []byte(data)
+	}
+	return content
+}
+
+// converse reasoning block => anthropic thinking / redacted_thinking block
+func claudeThinkingBlock(reasoning types.ReasoningContentBlock) *ClaudeMessageContentBlock {
+	switch v := reasoning.(type) {
+	case *types.ReasoningContentBlockMemberReasoningText:
+		return &ClaudeMessageContentBlock{
+			Type:      "thinking",
+			Thinking:  aws.ToString(v.Value.Text),
+			Signature: aws.ToString(v.Value.Signature),
+		}
+	case *types.ReasoningContentBlockMemberRedactedContent:
+		return &ClaudeMessageContentBlock{
+			Type: "redacted_thinking",
+			Data: base64.StdEncoding.EncodeToString(v.Value),
+		}
+	}
+	return nil
+}
+
+// converse stop reason => anthropic stop_reason
+func claudeStopReason(stopReason types.StopReason) string {
+	switch stopReason {
+	case types.StopReasonGuardrailIntervened, types.StopReasonContentFiltered:
+		return "refusal"
+	case "":
+		return "end_turn"
+	}
+	return string(stopReason)
+}
+
+// stop_sequence of additionalModelResponseFields
+func readStopSequence(fields document.Interface) string {
+	if fields == nil {
+		return ""
+	}
+	var values map[string]interface{}
+	if err := fields.UnmarshalSmithyDocument(&values); err != nil {
+		return ""
+	}
+	stopSequence, _ := values["stop_sequence"].(string)
+	return stopSequence
+}
+
+// converse token usage => anthropic usage
+func claudeUsage(usage *types.TokenUsage) *ClaudeMessageUsage {
+	if usage == nil {
+		return &ClaudeMessageUsage{}
+	}
+	return &ClaudeMessageUsage{
+		InputTokens:              int(aws.ToInt32(usage.InputTokens)),
+		OutputTokens:             int(aws.ToInt32(usage.OutputTokens)),
+		CacheCreationInputTokens: int(aws.ToInt32(usage.CacheWriteInputTokens)),
+		CacheReadInputTokens:     int(aws.ToInt32(usage.CacheReadInputTokens)),
+	}
+}
+
+// call Converse or ConverseStream, the result has the same shape as the invoke backend
+func (client *BedrockClient) converseCompletion(ctx context.Context, req *ClaudeMessageCompletionRequest, modelId string) (IStreamableResponse, error) {
+	input, err := newConverseRequest(ctx, req, modelId)
+	if err != nil {
+		return nil, err
+	}
+	guardrail := client.config.Guardrail
+
+	ctx, cancel := client.upstreamContext(ctx, req.Model, modelId)
+
+	if req.Stream {
+		streamInput := &bedrock.ConverseStreamInput{
+			ModelId:                           aws.String(modelId),
+			System:                            input.System,
+			Messages:                          input.Messages,
+			InferenceConfig:                   input.InferenceConfig,
+			ToolConfig:                        input.ToolConfig,
+			AdditionalModelRequestFields:      input.AdditionalModelRequestFields,
+			AdditionalModelResponseFieldPaths: input.AdditionalModelResponseFieldPaths,
+			RequestMetadata:                   input.RequestMetadata,
+		}
+		if guardrail != nil {
+			streamInput.GuardrailConfig = &types.GuardrailStreamConfiguration{
+				GuardrailIdentifier:  aws.String(guardrail.Identifier),
+				GuardrailVersion:     aws.String(guardrail.GetVersion()),
+				Trace:                types.GuardrailTrace(guardrail.Trace),
+				StreamProcessingMode: types.GuardrailStreamProcessingMode(guardrail.StreamProcessingMode),
+			}
+		}
+		output, err := client.client.ConverseStream(ctx, streamInput)
+		if err != nil {
+			cancel()
+			Log.Error(err)
+			return nil, err
+		}
+
+		eventQueue := PumpConverseStream(ctx, output.GetStream(), modelId, cancel)
+		return NewStreamMessageCompleteResponse(eventQueue), nil
+	}
+
+	defer cancel()
+	converseInput := &bedrock.ConverseInput{
+		ModelId:                           aws.String(modelId),
+		System:                            input.System,
+		Messages:                          input.Messages,
+		InferenceConfig:                   input.InferenceConfig,
+		ToolConfig:                        input.ToolConfig,
+		AdditionalModelRequestFields:      input.AdditionalModelRequestFields,
+		AdditionalModelResponseFieldPaths: input.AdditionalModelResponseFieldPaths,
+		RequestMetadata:                   input.RequestMetadata,
+	}
+	if guardrail != nil {
+		converseInput.GuardrailConfig = &types.GuardrailConfiguration{
+			GuardrailIdentifier: aws.String(guardrail.Identifier),
+			GuardrailVersion:    aws.String(guardrail.GetVersion()),
+			Trace:               types.GuardrailTrace(guardrail.Trace),
+		}
+	}
+	output, err := client.client.Converse(ctx, converseInput)
+	if err != nil {
+		Log.Error(err)
+		return nil, err
+	}
+	if output.Metrics != nil {
+		Log.Debugf("converse latency: %dms", aws.ToInt64(output.Metrics.LatencyMs))
+	}
+
+	resp := &ClaudeMessageCompletionResponse{
+		Id:      newMessageId(),
+		Model:   modelId,
+		Type:    "message",
+		Role:    "assistant",
+		Content: []*ClaudeMessageContentBlock{},
+		Usage:   claudeUsage(output.Usage),
+	}
+	resp.StopReason = claudeStopReason(output.StopReason)
+	resp.StopSequence = readStopSequence(output.AdditionalModelResponseFields)
+	if output.Trace != nil {
+		resp.Trace = output.Trace
+	}
+
+	message, ok := output.Output.(*types.ConverseOutputMemberMessage)
+	if !ok {
+		return nil, fmt.Errorf("unknown converse output")
+	}
+	for _, block := range message.Value.Content {
+		switch v := block.(type) {
+		case *types.ContentBlockMemberText:
+			resp.Content = append(resp.Content, &ClaudeMessageContentBlock{Type: "text", Text: v.Value})
+		case *types.ContentBlockMemberToolUse:
+			resp.Content = append(resp.Content, &ClaudeMessageContentBlock{
+				Type:  "tool_use",
+				Id:    aws.ToString(v.Value.ToolUseId),
+				Name:  aws.ToString(v.Value.Name),
+				Input: documentToJSON(v.Value.Input),
+			})
+		case *types.ContentBlockMemberReasoningContent:
+			if thinking := claudeThinkingBlock(v.Value); thinking != nil {
+				resp.Content = append(resp.Content, thinking)
+			}
+		default:
+			Log.Debugf("skip converse content block %T", block)
+		}
+	}
+
+	return NewMessageCompleteResponse(resp), nil
+}
+
+// read converse stream in a goroutine and send anthropic stream events to the returned queue,
+// same as PumpBedrockStream
+func PumpConverseStream(ctx context.Context, stream IConverseEventStream, model string, release func()) <-chan ISSEDecoder {
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+
+	go func() {
+		defer release()
+		defer stream.Close()
+		defer close(eventQueue)
+
+		converter := newConverseStreamConverter(model)
+		send := func(payloads [][]byte) bool {
+			for _, payload := range payloads {
+				var resp ClaudeMessageCompletionStreamEvent
+				err := json.NewDecoder(bytes.NewReader(payload)).Decode(&resp)
+				if err != nil {
+					Log.Error(err)
+					continue
+				}
+				resp.Raw = payload
+				select {
+				case eventQueue <- &resp:
+				case <-ctx.Done():
+					Log.Debugf("stop reading converse stream, %v", ctx.Err())
+					sendStreamError(ctx, nil, eventQueue)
+					return false
+				}
+			}
+			return true
+		}
+
+		for {
+			var event types.ConverseStreamOutput
+			var ok bool
+			select {
+			case <-ctx.Done():
+				Log.Debugf("stop reading converse stream, %v", ctx.Err())
+				sendStreamError(ctx, nil, eventQueue)
+				return
+			case event, ok = <-stream.Events():
+				if !ok {
+					if stream.Err() != nil || ctx.Err() != nil {
+						sendStreamError(ctx, stream.Err(), eventQueue)
+						return
+					}
+					send(converter.finish())
+					return
+				}
+			}
+
+			if !send(converter.convert(event)) {
+				return
+			}
+		}
+	}()
+
+	return eventQueue
+}
+
+// converts converse stream events to anthropic stream event payloads
+type converseStreamConverter struct {
+	model        string
+	started      map[int32]bool
+	stopReason   string
+	stopSequence string
+	stopped      bool
+}
+
+func newConverseStreamConverter(model string) *converseStreamConverter {
+	return &converseStreamConverter{
+		model:   model,
+		started: map[int32]bool{},
+	}
+}
+
+// json payload of an anthropic stream event
+func newStreamPayload(eventType string, fields map[string]interface{}) []byte {
+	fields["type"] = eventType
+	raw, _ := json.Marshal(fields)
+	return raw
+}
+
+func (converter *converseStreamConverter) convert(event types.ConverseStreamOutput) [][]byte {
+	payloads := [][]byte{}
+	switch v := event.(type) {
+	case *types.ConverseStreamOutputMemberMessageStart:
+		payloads = append(payloads, newStreamPayload("message_start", map[string]interface{}{
+			"message": map[string]interface{}{
+				"id":            newMessageId(),
+				"type":          "message",
+				"role":          "assistant",
+				"content":       []interface{}{},
+				"model":         converter.model,
+				"stop_reason":   nil,
+				"stop_sequence": nil,
+				"usage": map[string]int{
+					"input_tokens":                0,
+					"output_tokens":               0,
+					"cache_creation_input_tokens": 0,
+					"cache_read_input_tokens":     0,
+				},
+			},
+		}))
+	case *types.ConverseStreamOutputMemberContentBlockStart:
+		index := aws.ToInt32(v.Value.ContentBlockIndex)
+		toolUse, ok := v.Value.Start.(*types.ContentBlockStartMemberToolUse)
+		if !ok {
+			break
+		}
+		converter.started[index] = true
+		payloads = append(payloads, newStreamPayload("content_block_start", map[string]interface{}{
+			"index": index,
+			"content_block": map[string]interface{}{
+				"type":  "tool_use",
+				"id":    aws.ToString(toolUse.Value.ToolUseId),
+				"name":  aws.ToString(toolUse.Value.Name),
+				"input": map[string]interface{}{},
+			},
+		}))
+	case *types.ConverseStreamOutputMemberContentBlockDelta:
+		index := aws.ToInt32(v.Value.ContentBlockIndex)
+		switch delta := v.Value.Delta.(type) {
+		case *types.ContentBlockDeltaMemberText:
+			// converse does not start text blocks
+			if !converter.started[index] {
+				converter.started[index] = true
+				payloads = append(payloads, newStreamPayload("content_block_start", map[string]interface{}{
+					"index":         index,
+					"content_block": map[string]interface{}{"type": "text", "text": ""},
+				}))
+			}
+			payloads = append(payloads, newStreamPayload("content_block_delta", map[string]interface{}{
+				"index": index,
+				"delta": map[string]interface{}{"type": "text_delta", "text": delta.Value},
+			}))
+		case *types.ContentBlockDeltaMemberToolUse:
+			payloads = append(payloads, newStreamPayload("content_block_delta", map[string]interface{}{
+				"index": index,
+				"delta": map[string]interface{}{"type": "input_json_delta", "partial_json": aws.ToString(delta.Value.Input)},
+			}))
+		case *types.ContentBlockDeltaMemberReasoningContent:
+			payloads = append(payloads, converter.reasoning(index, delta.Value)...)
+		default:
+			Log.Debugf("skip converse delta %T", delta)
+		}
+	case *types.ConverseStreamOutputMemberContentBlockStop:
+		index := aws.ToInt32(v.Value.ContentBlockIndex)
+		if converter.started[index] {
+			payloads = append(payloads, newStreamPayload("content_block_stop", map[string]interface{}{
+				"index": index,
+			}))
+		}
+	case *types.ConverseStreamOutputMemberMessageStop:
+		// wait for the metadata event with usage
+		converter.stopReason = claudeStopReason(v.Value.StopReason)
+		converter.stopSequence = readStopSequence(v.Value.AdditionalModelResponseFields)
+	case *types.ConverseStreamOutputMemberMetadata:
+		usage := claudeUsage(v.Value.Usage)
+		messageStop := map[string]interface{}{}
+		if v.Value.Metrics != nil {
+			// same as the invocation metrics of InvokeModelWithResponseStream
+			messageStop["amazon-bedrock-invocationMetrics"] = map[string]interface{}{
+				"inputTokenCount":           usage.InputTokens,
+				"outputTokenCount":          usage.OutputTokens,
+				"cacheReadInputTokenCount":  usage.CacheReadInputTokens,
+				"cacheWriteInputTokenCount": usage.CacheCreationInputTokens,
+				"invocationLatency":         aws.ToInt64(v.Value.Metrics.LatencyMs),
+			}
+		}
+		if v.Value.Trace != nil {
+			messageStop["amazon-bedrock-trace"] = v.Value.Trace
+		}
+		payloads = append(payloads, converter.stop(usage, messageStop)...)
+	case *types.UnknownUnionMember:
+		Log.Errorf("unknown tag: %s", v.Tag)
+	default:
+		Log.Errorf("union is nil or unknown type")
+	}
+	return payloads
+}
+
+// thinking_delta / signature_delta of a thinking block, converse does not start reasoning blocks.
+// redacted content is sent as a whole redacted_thinking block
+func (converter *converseStreamConverter) reasoning(index int32, delta types.ReasoningContentBlockDelta) [][]byte {
+	payloads := [][]byte{}
+	if redacted, ok := delta.(*types.ReasoningContentBlockDeltaMemberRedactedContent); ok {
+		if !converter.started[index] {
+			converter.started[index] = true
+			payloads = append(payloads, newStreamPayload("content_block_start", map[string]interface{}{
+				"index":         index,
+				"content_block": map[string]interface{}{"type": "redacted_thinking", "data": base64.StdEncoding.EncodeToString(redacted.Value)},
+			}))
+		}
+		return payloads
+	}
+	if !converter.started[index] {
+		converter.started[index] = true
+		payloads = append(payloads, newStreamPayload("content_block_start", map[string]interface{}{
+			"index":         index,
+			"content_block": map[string]interface{}{"type": "thinking", "thinking": "", "signature": ""},
+		}))
+	}
+	switch v := delta.(type) {
+	case *types.ReasoningContentBlockDeltaMemberText:
+		payloads = append(payloads, newStreamPayload("content_block_delta", map[string]interface{}{
+			"index": index,
+			"delta": map[string]interface{}{"type": "thinking_delta", "thinking": v.Value},
+		}))
+	case *types.ReasoningContentBlockDeltaMemberSignature:
+		payloads = append(payloads, newStreamPayload("content_block_delta", map[string]interface{}{
+			"index": index,
+			"delta": map[string]interface{}{"type": "signature_delta", "signature": v.Value},
+		}))
+	default:
+		Log.Debugf("skip converse reasoning delta %T", delta)
+	}
+	return payloads
+}
+
+// message_delta and message_stop
+func (converter *converseStreamConverter) stop(usage *ClaudeMessageUsage, messageStop map[string]interface{}) [][]byte {
+	if converter.stopped {
+		return nil
+	}
+	converter.stopped = true
+	delta := map[string]interface{}{"stop_reason": converter.stopReason, "stop_sequence": nil}
+	if len(converter.stopSequence) > 0 {
+		delta["stop_sequence"] = converter.stopSequence
+	}
+	return [][]byte{
+		newStreamPayload("message_delta", map[string]interface{}{
+			"delta": delta,
+			"usage": usage,
+		}),
+		newStreamPayload("message_stop", messageStop),
+	}
+}
+
+// stream ended without metadata
+func (converter *converseStreamConverter) finish() [][]byte {
+	if len(converter.stopReason) == 0 {
+		return nil
+	}
+	return converter.stop(&ClaudeMessageUsage{}, map[string]interface{}{})
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+// ---------------------
+// anthropic error types
+// ---------------------
+const (
+	ErrorTypeInvalidRequest  = "invalid_request_error"
+	ErrorTypeAuthentication  = "authentication_error"
+	ErrorTypePermission      = "permission_error"
+	ErrorTypeNotFound        = "not_found_error"
+	ErrorTypeRequestTooLarge = "request_too_large"
+	ErrorTypeRateLimit       = "rate_limit_error"
+	ErrorTypeAPI             = "api_error"
+	ErrorTypeOverloaded      = "overloaded_error"
+)
+
+// http status used by anthropic for overloaded_error
+const StatusOverloaded = 529
+
+// default retry-after (seconds) when bedrock does not send one
+const (
+	rateLimitRetryAfter  = 5
+	overloadedRetryAfter = 10
+)
+
+// error with anthropic error type, http status and retry-after
+type ClaudeAPIError struct {
+	Type       string
+	StatusCode int
+	RetryAfter int
+	Message    string
+	Err        error
+}
+
+// error of client request, e.g. bad json body
+func NewInvalidRequestError(err error) *ClaudeAPIError {
+	return &ClaudeAPIError{
+		Type:       ErrorTypeInvalidRequest,
+		StatusCode: http.StatusBadRequest,
+		Message:    err.Error(),
+		Err:        err,
+	}
+}
+
+func (e *ClaudeAPIError) Error() string {
+	return e.Message
+}
+
+func (e *ClaudeAPIError) Unwrap() error {
+	return e.Err
+}
+
+// translate bedrock / sdk errors to anthropic error type and http status
+func TranslateError(err error) *ClaudeAPIError {
+	var apiErr *ClaudeAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	result := &ClaudeAPIError{
+		Type:       ErrorTypeAPI,
+		StatusCode: http.StatusInternalServerError,
+		Message:    err.Error(),
+		Err:        err,
+	}
+
+	// upstream timeout reached
+	if errors.Is(err, context.DeadlineExceeded) {
+		result.StatusCode = http.StatusGatewayTimeout
+		return result
+	}
+
+	// aws credentials can not be retrieved, or sts failed while refreshing them
+	var credentialsErr *CredentialsError
+	if errors.As(err, &credentialsErr) || isSTSError(err) {
+		result.Type = ErrorTypeAuthentication
+		result.StatusCode = http.StatusUnauthorized
+		return result
+	}
+
+	var smithyErr smithy.APIError
+	if errors.As(err, &smithyErr) {
+		switch smithyErr.ErrorCode() {
+		case "ThrottlingException", "TooManyRequestsException", "ServiceQuotaExceededException":
+			result.Type = ErrorTypeRateLimit
+			result.StatusCode = http.StatusTooManyRequests
+			result.RetryAfter = rateLimitRetryAfter
+		case "ModelNotReadyException", "ServiceUnavailableException":
+			result.Type = ErrorTypeOverloaded
+			result.StatusCode = StatusOverloaded
+			result.RetryAfter = overloadedRetryAfter
+		case "ValidationException":
+			result.Type = ErrorTypeInvalidRequest
+			result.StatusCode = http.StatusBadRequest
+		case "AccessDeniedException", "UnrecognizedClientException":
+			result.Type = ErrorTypePermission
+			result.StatusCode = http.StatusForbidden
+		case "ResourceNotFoundException":
+			result.Type = ErrorTypeNotFound
+			result.StatusCode = http.StatusNotFound
+		case "ModelTimeoutException", "ModelErrorException", "ModelStreamErrorException", "InternalServerException":
+			result.Type = ErrorTypeAPI
+			result.StatusCode = http.StatusInternalServerError
+		default:
+			translateHTTPStatus(err, result)
+		}
+		readRetryAfter(err, result)
+		return result
+	}
+
+	translateHTTPStatus(err, result)
+	readRetryAfter(err, result)
+	return result
+}
+
+// the error is caused by a sts operation, e.g. refreshing assumed role
+func isSTSError(err error) bool {
+	for err != nil {
+		var operationErr *smithy.OperationError
+		if !errors.As(err, &operationErr) {
+			return false
+		}
+		if operationErr.ServiceID == "STS" {
+			return true
+		}
+		err = operationErr.Err
+	}
+	return false
+}
+
+// fallback on the http status of bedrock response
+func translateHTTPStatus(err error, result *ClaudeAPIError) {
+	var responseErr *awshttp.ResponseError
+	if !errors.As(err, &responseErr) {
+		return
+	}
+	switch status := responseErr.HTTPStatusCode(); {
+	case status == http.StatusTooManyRequests:
+		result.Type = ErrorTypeRateLimit
+		result.StatusCode = status
+		result.RetryAfter = rateLimitRetryAfter
+	case status == http.StatusServiceUnavailable:
+		result.Type = ErrorTypeOverloaded
+		result.StatusCode = StatusOverloaded
+		result.RetryAfter = overloadedRetryAfter
+	case status == http.StatusUnauthorized:
+		result.Type = ErrorTypeAuthentication
+		result.StatusCode = status
+	case status == http.StatusForbidden:
+		result.Type = ErrorTypePermission
+		result.StatusCode = status
+	case status == http.StatusNotFound:
+		result.Type = ErrorTypeNotFound
+		result.StatusCode = status
+	case status == http.StatusRequestEntityTooLarge:
+		result.Type = ErrorTypeRequestTooLarge
+		result.StatusCode = status
+	case status >= 400 && status < 500:
+		result.Type = ErrorTypeInvalidRequest
+		result.StatusCode = http.StatusBadRequest
+	}
+}
+
+// use retry-after of bedrock response if present
+func readRetryAfter(err error, result *ClaudeAPIError) {
+	var responseErr *awshttp.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.Response == nil {
+		return
+	}
+	retryAfter, parseErr := strconv.Atoi(responseErr.Response.Header.Get("Retry-After"))
+	if parseErr == nil && retryAfter > 0 {
+		result.RetryAfter = retryAfter
+	}
+}
@@ -0,0 +1,240 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// ---------------------
+// model fallback chains
+// ---------------------
+// bedrock model ids of an alias, tried in order until one serves the request.
+// a single model id is accepted in json, e.g. "sonnet": "anthropic.xxx"
+type ModelChain []string
+
+func (chain *ModelChain) UnmarshalJSON(data []byte) error {
+	var modelId string
+	if json.Unmarshal(data, &modelId) == nil {
+		*chain = ModelChain{modelId}
+		return nil
+	}
+	var modelIds []string
+	err := json.Unmarshal(data, &modelIds)
+	if err != nil {
+		return err
+	}
+	*chain = modelIds
+	return nil
+}
+
+// single model chains are written as string
+func (chain ModelChain) MarshalJSON() ([]byte, error) {
+	if len(chain) == 1 {
+		return json.Marshal(chain[0])
+	}
+	return json.Marshal([]string(chain))
+}
+
+// first model of chain, empty if none
+func (chain ModelChain) First() string {
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[0]
+}
+
+// parse model mappings str, model ids of a chain are separated by |,
+// e.g. sonnet=anthropic.a|anthropic.b,haiku=anthropic.c
+func ParseModelMappingsFromStr(raw string) map[string]ModelChain {
+	mappings := map[string]ModelChain{}
+	for alias, value := range ParseMappingsFromStr(raw) {
+		chain := ModelChain{}
+		for _, modelId := range strings.Split(value, "|") {
+			modelId = strings.TrimSpace(modelId)
+			if len(modelId) > 0 {
+				chain = append(chain, modelId)
+			}
+		}
+		if len(chain) > 0 {
+			mappings[alias] = chain
+		}
+	}
+	return mappings
+}
+
+// errors falling back to the next model of chain by default:
+// throttled, model not ready / unavailable, or model not enabled in the account
+var defaultFallbackOn = []string{
+	"ThrottlingException",
+	"ServiceQuotaExceededException",
+	"ModelNotReadyException",
+	"ServiceUnavailableException",
+	"AccessDeniedException",
+	"ResourceNotFoundException",
+}
+
+// load fallback rules from env, comma separated
+func loadFallbackOnWithEnv() []string {
+	return ParseListFromStr(os.Getenv("AWS_BEDROCK_FALLBACK_ON"))
+}
+
+// model ids of alias in order with inference profile prefix, the default model if empty
+func (config *BedrockConfig) GetModelChain(model string) ModelChain {
+	if len(model) == 0 {
+		model = config.AnthropicDefaultModel
+	}
+	chain, exist := config.ModelMappings[model]
+	if !exist || len(chain) == 0 {
+		chain = ModelChain{model}
+	}
+	resolved := ModelChain{}
+	for _, modelId := range chain {
+		resolved = append(resolved, config.ResolveModelId(modelId))
+	}
+	return resolved
+}
+
+// the error lets the next model of chain be tried. fallback_on rules are bedrock
+// error codes (e.g. ThrottlingException) or anthropic error types (e.g. rate_limit_error)
+func (config *BedrockConfig) IsFallbackError(err error) bool {
+	rules := config.FallbackOn
+	if len(rules) == 0 {
+		rules = defaultFallbackOn
+	}
+	errorCode := ""
+	var smithyErr smithy.APIError
+	if errors.As(err, &smithyErr) {
+		errorCode = smithyErr.ErrorCode()
+	}
+	errorType := TranslateError(err).Type
+	for _, rule := range rules {
+		if rule == errorCode || rule == errorType {
+			return true
+		}
+	}
+	return false
+}
+
+// call the models of chain in order until one succeeds, streams failing before
+// the first event fall back too. responses of fallback models report the model that served them
+func (client *BedrockClient) MessageCompletion(ctx context.Context, req *ClaudeMessageCompletionRequest) (IStreamableResponse, error) {
+	chain := client.config.GetModelChain(req.Model)
+	var err error
+	for i, modelId := range chain {
+		var response IStreamableResponse
+		response, err = client.messageCompletion(ctx, req, modelId)
+		if err == nil && response != nil && response.IsStream() {
+			response, err = client.peekFallbackStream(ctx, response)
+		}
+		if err == nil {
+			if response == nil {
+				return response, nil
+			}
+			response = withUsageMetrics(ctx, response, modelId)
+			if i > 0 {
+				return withServedModel(ctx, response, modelId), nil
+			}
+			return response, nil
+		}
+		if i == len(chain)-1 || ctx.Err() != nil || !client.config.IsFallbackError(err) {
+			break
+		}
+		Log.Warningf("model %s of %s failed, fall back to %s, %v", modelId, req.Model, chain[i+1], err)
+		CountMetric("model_fallbacks")
+	}
+	return nil, err
+}
+
+// read the first event of stream, a stream failing right away with a fallback error
+// is returned as the error so that the next model of chain can be tried
+func (client *BedrockClient) peekFallbackStream(ctx context.Context, response IStreamableResponse) (IStreamableResponse, error) {
+	var first ISSEDecoder
+	select {
+	case event, ok := <-response.GetEvents():
+		if !ok {
+			return response, nil
+		}
+		first = event
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if errorEvent, ok := first.(*SSEErrorEvent); ok && client.config.IsFallbackError(errorEvent.Error) {
+		// the producer stops after an error event, read what is left so it can exit
+		go func() {
+			for range response.GetEvents() {
+			}
+		}()
+		return nil, errorEvent.Error
+	}
+	return withFirstEvent(ctx, first, response), nil
+}
+
+// stream of first followed by the remaining events of response
+func withFirstEvent(ctx context.Context, first ISSEDecoder, response IStreamableResponse) IStreamableResponse {
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+	eventQueue <- first
+	go func() {
+		defer close(eventQueue)
+		for event := range response.GetEvents() {
+			select {
+			case eventQueue <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return NewStreamMessageCompleteResponse(eventQueue)
+}
+
+// set model of response or of the message_start event to the model that served the request
+func withServedModel(ctx context.Context, response IStreamableResponse, modelId string) IStreamableResponse {
+	if !response.IsStream() {
+		resp, ok := response.GetResponse().(*ClaudeMessageCompletionResponse)
+		if ok && resp != nil {
+			resp.Model = modelId
+		}
+		return response
+	}
+
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+	go func() {
+		defer close(eventQueue)
+		for event := range response.GetEvents() {
+			if v, ok := event.(*ClaudeMessageCompletionStreamEvent); ok && v.Type == "message_start" {
+				setMessageStartModel(v, modelId)
+			}
+			select {
+			case eventQueue <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return NewStreamMessageCompleteResponse(eventQueue)
+}
+
+// patch model of message_start, fields unknown to the struct are kept in raw
+func setMessageStartModel(event *ClaudeMessageCompletionStreamEvent, modelId string) {
+	if event.Message != nil {
+		event.Message.Model = modelId
+	}
+	var payload map[string]json.RawMessage
+	if json.Unmarshal(event.Raw, &payload) != nil {
+		return
+	}
+	var message map[string]json.RawMessage
+	if json.Unmarshal(payload["message"], &message) != nil {
+		return
+	}
+	message["model"], _ = json.Marshal(modelId)
+	payload["message"], _ = json.Marshal(message)
+	raw, err := json.Marshal(payload)
+	if err == nil {
+		event.Raw = raw
+	}
+}
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"strings"
+)
+
+// ---------------------
+// model families
+// ---------------------
+// names of model families
+const (
+	ModelFamilyAnthropic = "anthropic"
+	ModelFamilyNova      = "nova"
+	ModelFamilyTitan     = "titan"
+	ModelFamilyLlama     = "llama"
+	ModelFamilyMistral   = "mistral"
+	ModelFamilyCohere    = "cohere"
+	ModelFamilyDeepSeek  = "deepseek"
+	ModelFamilyOther     = "other"
+)
+
+// features of a model family supported by the converse api
+type ModelFamily struct {
+	Name string
+	// part of the model id, also matches inference profiles and arns
+	Match         string
+	System        bool
+	Tools         bool
+	StopSequences bool
+	// prompt caching with cache points
+	CachePoints bool
+	// how top_k is passed in additionalModelRequestFields, empty if not supported
+	TopK string
+}
+
+// top_k fields of additionalModelRequestFields
+const (
+	topKSnakeCase = "top_k"
+	topKNova      = "inferenceConfig.topK"
+)
+
+// checked in order, the first match wins
+var modelFamilies = []*ModelFamily{
+	{Name: ModelFamilyAnthropic, Match: "anthropic.", System: true, Tools: true, StopSequences: true, CachePoints: true, TopK: topKSnakeCase},
+	{Name: ModelFamilyNova, Match: "amazon.nova", System: true, Tools: true, StopSequences: true, CachePoints: true, TopK: topKNova},
+	{Name: ModelFamilyTitan, Match: "amazon.titan", StopSequences: true},
+	{Name: ModelFamilyLlama, Match: "meta.llama", System: true, Tools: true},
+	{Name: ModelFamilyMistral, Match: "mistral.mistral-large", System: true, Tools: true, StopSequences: true, TopK: topKSnakeCase},
+	{Name: ModelFamilyMistral, Match: "mistral.mistral-small", System: true, Tools: true, StopSequences: true, TopK: topKSnakeCase},
+	{Name: ModelFamilyMistral, Match: "mistral.pixtral", System: true, Tools: true, StopSequences: true, TopK: topKSnakeCase},
+	// mistral / mixtral instruct models
+	{Name: ModelFamilyMistral, Match: "mistral.", StopSequences: true, TopK: topKSnakeCase},
+	{Name: ModelFamilyCohere, Match: "cohere.command-r", System: true, Tools: true, StopSequences: true},
+	{Name: ModelFamilyCohere, Match: "cohere.command", StopSequences: true},
+	{Name: ModelFamilyDeepSeek, Match: "deepseek.", System: true, StopSequences: true},
+}
+
+// unknown models, let bedrock reject what they do not support.
+// cache points are only sent to families known to support prompt caching
+var otherModelFamily = &ModelFamily{Name: ModelFamilyOther, System: true, Tools: true, StopSequences: true}
+
+// family of bedrock model id, inference profile id or arn.
+// application inference profiles not discovered are taken as anthropic models
+func GetModelFamily(modelId string) *ModelFamily {
+	if IsApplicationInferenceProfile(modelId) {
+		modelId = FoundationModelId(modelId)
+		if IsApplicationInferenceProfile(modelId) {
+			return modelFamilies[0]
+		}
+	}
+	for _, family := range modelFamilies {
+		if strings.Contains(modelId, family.Match) {
+			return family
+		}
+	}
+	return otherModelFamily
+}
+
+// only anthropic models accept the anthropic body of InvokeModel
+func (family *ModelFamily) IsAnthropic() bool {
+	return family.Name == ModelFamilyAnthropic
+}
+
+// additionalModelRequestFields with top_k, nil if not supported
+func (family *ModelFamily) TopKFields(topK int) map[string]interface{} {
+	switch family.TopK {
+	case topKSnakeCase:
+		return map[string]interface{}{"top_k": topK}
+	case topKNova:
+		return map[string]interface{}{"inferenceConfig": map[string]interface{}{"topK": topK}}
+	}
+	return nil
+}
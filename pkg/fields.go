@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// ---------------------
+// fields unknown to the proxy
+// ---------------------
+// unknown fields of requests are forwarded to bedrock, except these rejected by bedrock
+var defaultDropFields = []string{"service_tier", "container", "mcp_servers"}
+
+// fields of request read by the proxy, including the ones not sent to bedrock
+var requestFieldNames = jsonFieldNames(reflect.TypeOf(ClaudeMessageCompletionRequest{}), "stream", "model", "metadata")
+
+// fields of tool definition read by the proxy
+var toolFieldNames = jsonFieldNames(reflect.TypeOf(ClaudeMessageCompletionRequestTools{}))
+
+// json names of the fields of struct type
+func jsonFieldNames(structType reflect.Type, names ...string) map[string]bool {
+	fieldNames := map[string]bool{}
+	for _, name := range names {
+		fieldNames[name] = true
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		name := strings.Split(structType.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) > 0 && name != "-" {
+			fieldNames[name] = true
+		}
+	}
+	return fieldNames
+}
+
+// fields of json object not in known, nil if none
+func unknownFields(data []byte, known map[string]bool) (map[string]json.RawMessage, error) {
+	var object map[string]json.RawMessage
+	err := json.Unmarshal(data, &object)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	for name, value := range object {
+		if known[name] {
+			continue
+		}
+		if fields == nil {
+			fields = map[string]json.RawMessage{}
+		}
+		fields[name] = value
+	}
+	return fields, nil
+}
+
+// add fields to json object, fields set in the object are kept
+func withExtraFields(data []byte, fields map[string]json.RawMessage) ([]byte, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+	var object map[string]json.RawMessage
+	err := json.Unmarshal(data, &object)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range fields {
+		if _, exist := object[name]; !exist {
+			object[name] = value
+		}
+	}
+	return json.Marshal(object)
+}
+
+// the unknown field is forwarded to bedrock, name of tool fields is e.g. tools.strict.
+// only forward_fields are forwarded if set, otherwise all but drop_fields
+func (config *BedrockConfig) ForwardsField(name string) bool {
+	if len(config.ForwardFields) > 0 {
+		return containsString(config.ForwardFields, name)
+	}
+	dropFields := config.DropFields
+	if len(dropFields) == 0 {
+		dropFields = defaultDropFields
+	}
+	return !containsString(dropFields, name)
+}
+
+func containsString(items []string, item string) bool {
+	for _, value := range items {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
+
+// unknown fields forwarded to bedrock, nil if none
+func (config *BedrockConfig) forwardedFields(prefix string, fields map[string]json.RawMessage) map[string]json.RawMessage {
+	var forwarded map[string]json.RawMessage
+	for name, value := range fields {
+		if !config.ForwardsField(prefix + name) {
+			Log.Debugf("field %s%s is not forwarded to bedrock", prefix, name)
+			continue
+		}
+		if forwarded == nil {
+			forwarded = map[string]json.RawMessage{}
+		}
+		forwarded[name] = value
+	}
+	return forwarded
+}
+
+// copy of request without the unknown fields that are not forwarded to bedrock
+func (config *BedrockConfig) filterRequestFields(req *ClaudeMessageCompletionRequest) *ClaudeMessageCompletionRequest {
+	filtered := *req
+	filtered.Extra = config.forwardedFields("", req.Extra)
+	filtered.Tools = make([]*ClaudeMessageCompletionRequestTools, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		if tool != nil && len(tool.Extra) > 0 {
+			toolCopy := *tool
+			toolCopy.Extra = config.forwardedFields("tools.", tool.Extra)
+			tool = &toolCopy
+		}
+		filtered.Tools = append(filtered.Tools, tool)
+	}
+	return &filtered
+}
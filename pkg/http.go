@@ -1,24 +1,55 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type HttpConfig struct {
-	Listen  string `json:"listen,omitempty"`
-	WebRoot string `json:"web_root,omitempty"`
-	APIKey  string `json:"api_key,omitempty"`
+	Listen       string `json:"listen,omitempty"`
+	WebRoot      string `json:"web_root,omitempty"`
+	APIKey       string `json:"api_key,omitempty"`
+	PingInterval int    `json:"ping_interval,omitempty"`
+}
+
+// default interval of SSE ping events
+const defaultPingInterval = 15 * time.Second
+
+// interval of SSE ping events when upstream is silent, 0 disables ping
+func (config *HttpConfig) GetPingInterval() time.Duration {
+	if config.PingInterval < 0 {
+		return 0
+	}
+	if config.PingInterval == 0 {
+		return defaultPingInterval
+	}
+	return time.Duration(config.PingInterval) * time.Second
 }
 
 type HTTPService struct {
-	conf *Config
+	conf      *Config
+	router    *BedrockRouter
+	responses *ResponseStore
+	batches   *BatchManager
+	batchErr  error
 }
 
+// interval of retrying bedrock client initialisation of targets
+const (
+	bedrockInitMinInterval = 5 * time.Second
+	bedrockInitMaxInterval = 2 * time.Minute
+)
+
 type APIError struct {
 	Type    string `json:"type,omitempty"`
 	Message string `json:"message,omitempty"`
@@ -30,9 +61,37 @@ type APIStandardError struct {
 }
 
 func NewHttpService(conf *Config) *HTTPService {
-	return &HTTPService{
-		conf: conf,
+	service := &HTTPService{
+		conf:      conf,
+		router:    NewBedrockRouter(conf.BedrockConfig),
+		responses: NewResponseStore(),
+	}
+	batchConfig := conf.BatchConfig
+	if batchConfig == nil {
+		batchConfig = &BatchConfig{}
 	}
+	service.batches, service.batchErr = NewBatchManager(batchConfig, service.completeBatchMessage)
+	if service.batchErr != nil {
+		Log.Errorf("unable to start message batches, %v", service.batchErr)
+	}
+	return service
+}
+
+// call bedrock through the router, the serving target is reported in the response header
+func (service *HTTPService) invoke(ctx context.Context, writer http.ResponseWriter, call RouteCall) (IStreamableResponse, error) {
+	response, target, err := service.router.Invoke(ctx, call)
+	if len(target) > 0 {
+		writer.Header().Set(BedrockTargetHeader, target)
+	}
+	return response, err
+}
+
+// messages api for batch workers
+func (service *HTTPService) completeBatchMessage(ctx context.Context, req *ClaudeMessageCompletionRequest) (IStreamableResponse, error) {
+	response, _, err := service.router.Invoke(ctx, func(ctx context.Context, client *BedrockClient) (IStreamableResponse, error) {
+		return client.MessageCompletion(ctx, req)
+	})
+	return response, err
 }
 
 func (service *HTTPService) RedirectSwagger(writer http.ResponseWriter, request *http.Request) {
@@ -40,21 +99,27 @@ func (service *HTTPService) RedirectSwagger(writer http.ResponseWriter, request
 }
 
 func (service *HTTPService) NotFoundHandle(writer http.ResponseWriter, request *http.Request) {
-	server_error := &APIStandardError{Type: "error", Error: &APIError{
-		Type:    "error",
-		Message: "not found",
-	}}
-	json_str, _ := json.Marshal(server_error)
-	http.Error(writer, string(json_str), http.StatusNotFound)
+	service.ResponseAPIError(ErrorTypeNotFound, http.StatusNotFound, fmt.Errorf("not found"), writer)
 }
 
+// response anthropic error with the status and type translated from err
 func (service *HTTPService) ResponseError(err error, writer http.ResponseWriter) {
+	apiErr := TranslateError(err)
+	if apiErr.RetryAfter > 0 {
+		writer.Header().Set("retry-after", strconv.Itoa(apiErr.RetryAfter))
+	}
+	service.ResponseAPIError(apiErr.Type, apiErr.StatusCode, apiErr, writer)
+}
+
+func (service *HTTPService) ResponseAPIError(errorType string, statusCode int, err error, writer http.ResponseWriter) {
 	server_error := &APIStandardError{Type: "error", Error: &APIError{
-		Type:    "invalid_request_error",
+		Type:    errorType,
 		Message: err.Error(),
 	}}
 	json_str, _ := json.Marshal(server_error)
-	http.Error(writer, string(json_str), http.StatusOK)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(json_str)
 }
 
 func (service *HTTPService) ResponseJSON(source interface{}, writer http.ResponseWriter) {
@@ -68,34 +133,80 @@ func (service *HTTPService) ResponseJSON(source interface{}, writer http.Respons
 	}
 }
 
-func (service *HTTPService) ResponseSSE(writer http.ResponseWriter, queue <-chan ISSEDecoder) {
+// write events of queue as SSE, stop on the first write error.
+// the caller must cancel the context of the producer after it returns,
+// so that the producer stops reading from bedrock.
+func (service *HTTPService) ResponseSSE(writer http.ResponseWriter, queue <-chan ISSEDecoder) error {
+	return service.ResponseSSEWithPing(writer, queue, NewSSERaw(&SSEPingEvent{}))
+}
+
+// same as ResponseSSE, with the frame written as keep-alive ping
+func (service *HTTPService) ResponseSSEWithPing(writer http.ResponseWriter, queue <-chan ISSEDecoder, pingFrame []byte) error {
 	// output & flush SSE
 	flusher, ok := writer.(http.Flusher)
 	if !ok {
-		service.ResponseError(fmt.Errorf("streaming not supported"), writer)
-		return
+		err := fmt.Errorf("streaming not supported")
+		service.ResponseError(err, writer)
+		return err
 	}
 	writer.Header().Set("Content-Type", "text/event-stream")
 	writer.Header().Set("Cache-Control", "no-cache")
 	writer.Header().Set("Connection", "keep-alive")
 
-	for event := range queue {
-		_, err := writer.Write(NewSSERaw(event))
+	// ping when upstream has been silent for the interval, frames are written
+	// one at a time from this goroutine so a ping never splits a frame
+	interval := service.conf.GetPingInterval()
+	var pingTimer *time.Timer
+	var pingC <-chan time.Time
+	if interval > 0 {
+		pingTimer = time.NewTimer(interval)
+		defer pingTimer.Stop()
+		pingC = pingTimer.C
+	}
+
+	for {
+		var frame []byte
+		select {
+		case event, ok := <-queue:
+			if !ok {
+				return nil
+			}
+			frame = NewSSERaw(event)
+		case <-pingC:
+			frame = pingFrame
+		}
+
+		_, err := writer.Write(frame)
 		if err != nil {
-			Log.Error(err)
-			continue
+			Log.Errorf("stop writing SSE, %v", err)
+			return err
 		}
 		flusher.Flush()
+
+		if pingTimer != nil {
+			resetTimer(pingTimer, interval)
+		}
+	}
+}
+
+// reset timer that may have fired
+func resetTimer(timer *time.Timer, interval time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
 	}
+	timer.Reset(interval)
 }
 
 func (service *HTTPService) HandleComplete(writer http.ResponseWriter, request *http.Request) {
 	if request.Method != "POST" {
-		service.ResponseError(fmt.Errorf("method not allowed"), writer)
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
 		return
 	}
 	if request.Header.Get("Content-Type") != "application/json" {
-		service.ResponseError(fmt.Errorf("invalid content type"), writer)
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusBadRequest, fmt.Errorf("invalid content type"), writer)
 		return
 	}
 	defer request.Body.Close()
@@ -103,15 +214,19 @@ func (service *HTTPService) HandleComplete(writer http.ResponseWriter, request *
 	var req *ClaudeTextCompletionRequest
 	err := json.NewDecoder(request.Body).Decode(&req)
 	if err != nil {
-		service.ResponseError(err, writer)
+		service.ResponseError(NewInvalidRequestError(err), writer)
 		return
 	}
 	// get anthropic-version,x-api-key from request
 	//anthropicVersion := request.Header.Get("anthropic-version")
 	//anthropicKey := request.Header.Get("x-api-key")
 
-	bedrockClient := NewBedrockClient(service.conf.BedrockConfig)
-	response, err := bedrockClient.CompleteText(req)
+	// stop reading bedrock stream once the handler returns
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	response, err := service.invoke(ctx, writer, func(ctx context.Context, client *BedrockClient) (IStreamableResponse, error) {
+		return client.CompleteText(ctx, req)
+	})
 	if err != nil {
 		service.ResponseError(err, writer)
 		return
@@ -119,44 +234,30 @@ func (service *HTTPService) HandleComplete(writer http.ResponseWriter, request *
 
 	if response.IsStream() {
 		// output & flush SSE
-		flusher, ok := writer.(http.Flusher)
-		if !ok {
-			service.ResponseError(fmt.Errorf("streaming not supported"), writer)
-			return
-		}
-		writer.Header().Set("Content-Type", "text/event-stream")
-		writer.Header().Set("Cache-Control", "no-cache")
-		writer.Header().Set("Connection", "keep-alive")
-
-		for event := range response.GetEvents() {
-			_, err = writer.Write(NewSSERaw(event))
-			if err != nil {
-				Log.Error(err)
-				continue
-			}
-			flusher.Flush()
-		}
+		service.ResponseSSE(writer, response.GetEvents())
 		return
 	}
 
 	service.ResponseJSON(response.GetResponse(), writer)
 }
 
-func (service *HTTPService) HandleMessageComplete(writer http.ResponseWriter, request *http.Request) {
+// read message request from body and anthropic-* headers
+func (service *HTTPService) readMessageRequest(request *http.Request) (*ClaudeMessageCompletionRequest, error) {
 	if request.Method != "POST" {
-		service.ResponseError(fmt.Errorf("method not allowed"), writer)
-		return
+		return nil, &ClaudeAPIError{
+			Type:       ErrorTypeInvalidRequest,
+			StatusCode: http.StatusMethodNotAllowed,
+			Message:    "method not allowed",
+		}
 	}
 	if request.Header.Get("Content-Type") != "application/json" {
-		service.ResponseError(fmt.Errorf("invalid content type"), writer)
-		return
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid content type"))
 	}
 
 	// 读取请求 body
 	body, err := io.ReadAll(request.Body)
 	if err != nil {
-		service.ResponseError(fmt.Errorf("error reading request body"), writer)
-		return
+		return nil, NewInvalidRequestError(fmt.Errorf("error reading request body"))
 	}
 	defer request.Body.Close()
 
@@ -164,15 +265,19 @@ func (service *HTTPService) HandleMessageComplete(writer http.ResponseWriter, re
 	var req ClaudeMessageCompletionRequest
 	err = json.Unmarshal(body, &req)
 	if err != nil {
-		service.ResponseError(err, writer)
-		return
+		return nil, NewInvalidRequestError(err)
+	}
+	err = req.ValidateTools()
+	if err != nil {
+		return nil, NewInvalidRequestError(err)
 	}
 	// get anthropic-version, anthropic-beta from request
 	anthropicVersion := request.Header.Get("anthropic-version")
 	if len(anthropicVersion) > 0 {
 		req.AnthropicVersion = anthropicVersion
 	}
-	anthropicBeta := request.Header.Values("anthropic-beta")
+	// betas are comma separated in one header, e.g. interleaved-thinking-2025-05-14,fine-grained-tool-streaming-2025-05-14
+	anthropicBeta := ParseListFromStr(strings.Join(request.Header.Values("anthropic-beta"), ","))
 	if len(anthropicBeta) > 0 {
 		req.AnthropicBeta = anthropicBeta
 	}
@@ -184,8 +289,22 @@ func (service *HTTPService) HandleMessageComplete(writer http.ResponseWriter, re
 		}
 	*/
 
-	bedrockClient := NewBedrockClient(service.conf.BedrockConfig)
-	response, err := bedrockClient.MessageCompletion(&req)
+	return &req, nil
+}
+
+func (service *HTTPService) HandleMessageComplete(writer http.ResponseWriter, request *http.Request) {
+	req, err := service.readMessageRequest(request)
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+
+	// stop reading bedrock stream once the handler returns
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	response, err := service.invoke(ctx, writer, func(ctx context.Context, client *BedrockClient) (IStreamableResponse, error) {
+		return client.MessageCompletion(ctx, req)
+	})
 	if err != nil {
 		service.ResponseError(err, writer)
 		return
@@ -200,6 +319,371 @@ func (service *HTTPService) HandleMessageComplete(writer http.ResponseWriter, re
 	service.ResponseJSON(response.GetResponse(), writer)
 }
 
+func (service *HTTPService) HandleCountTokens(writer http.ResponseWriter, request *http.Request) {
+	req, err := service.readMessageRequest(request)
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+
+	var response *ClaudeMessageCountTokensResponse
+	_, err = service.invoke(request.Context(), writer, func(ctx context.Context, client *BedrockClient) (IStreamableResponse, error) {
+		var countErr error
+		response, countErr = client.CountTokens(ctx, req)
+		return nil, countErr
+	})
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+
+	service.ResponseJSON(response, writer)
+}
+
+func (service *HTTPService) HandleListModels(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+		return
+	}
+	query := request.URL.Query()
+	limit := 0
+	if len(query.Get("limit")) > 0 {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			service.ResponseError(NewInvalidRequestError(fmt.Errorf("invalid limit")), writer)
+			return
+		}
+	}
+
+	list, err := service.conf.BedrockConfig.ListModels(query.Get("after_id"), query.Get("before_id"), limit)
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	service.ResponseJSON(list, writer)
+}
+
+func (service *HTTPService) HandleGetModel(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+		return
+	}
+	modelId := mux.Vars(request)["model_id"]
+	model := service.conf.BedrockConfig.GetModel(modelId)
+	if model == nil {
+		service.ResponseAPIError(ErrorTypeNotFound, http.StatusNotFound, fmt.Errorf("model: %s", modelId), writer)
+		return
+	}
+	service.ResponseJSON(model, writer)
+}
+
+func (service *HTTPService) HandleChatCompletions(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+		return
+	}
+	if !strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusBadRequest, fmt.Errorf("invalid content type"), writer)
+		return
+	}
+	defer request.Body.Close()
+	// json decode request body
+	var chatReq OpenAIChatCompletionRequest
+	err := json.NewDecoder(request.Body).Decode(&chatReq)
+	if err != nil {
+		service.ResponseError(NewInvalidRequestError(err), writer)
+		return
+	}
+
+	// stop reading bedrock stream once the handler returns
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	req, err := chatReq.ToClaudeRequest(ctx)
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	forcedFormat := chatReq.ResponseFormat != nil && chatReq.ResponseFormat.Type == "json_schema"
+
+	response, err := service.invoke(ctx, writer, func(ctx context.Context, client *BedrockClient) (IStreamableResponse, error) {
+		return client.MessageCompletion(ctx, req)
+	})
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+
+	if response.IsStream() {
+		includeUsage := chatReq.StreamOptions != nil && chatReq.StreamOptions.IncludeUsage
+		chunks := NewOpenAIChatCompletionStream(ctx, chatReq.Model, forcedFormat, includeUsage, response.GetEvents())
+		service.ResponseSSEWithPing(writer, chunks, openAIPingFrame)
+		return
+	}
+
+	resp, ok := response.GetResponse().(*ClaudeMessageCompletionResponse)
+	if !ok || resp == nil {
+		service.ResponseError(fmt.Errorf("empty response from bedrock"), writer)
+		return
+	}
+	service.ResponseJSON(NewOpenAIChatCompletionResponse(chatReq.Model, forcedFormat, resp), writer)
+}
+
+func (service *HTTPService) HandleResponses(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+		return
+	}
+	if !strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusBadRequest, fmt.Errorf("invalid content type"), writer)
+		return
+	}
+	defer request.Body.Close()
+	// json decode request body
+	var responseReq OpenAIResponseRequest
+	err := json.NewDecoder(request.Body).Decode(&responseReq)
+	if err != nil {
+		service.ResponseError(NewInvalidRequestError(err), writer)
+		return
+	}
+
+	// continue the stored conversation
+	var previous *StoredResponse
+	if len(responseReq.PreviousResponseId) > 0 {
+		previous = service.responses.Get(responseReq.PreviousResponseId)
+		if previous == nil {
+			service.ResponseAPIError(ErrorTypeNotFound, http.StatusNotFound, fmt.Errorf("previous response not found: %s", responseReq.PreviousResponseId), writer)
+			return
+		}
+	}
+
+	// stop reading bedrock stream once the handler returns
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	req, err := responseReq.ToClaudeRequest(ctx, previous)
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	// keep the conversation for previous_response_id
+	onComplete := func(response *OpenAIResponse) {
+		if responseReq.IsStore() {
+			service.responses.Save(response, req.Messages)
+		}
+	}
+
+	response, err := service.invoke(ctx, writer, func(ctx context.Context, client *BedrockClient) (IStreamableResponse, error) {
+		return client.MessageCompletion(ctx, req)
+	})
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+
+	if response.IsStream() {
+		events := NewOpenAIResponseStream(ctx, responseReq.NewResponse(), responseReq.IsForcedFormat(), response.GetEvents(), onComplete)
+		service.ResponseSSEWithPing(writer, events, openAIPingFrame)
+		return
+	}
+
+	resp, ok := response.GetResponse().(*ClaudeMessageCompletionResponse)
+	if !ok || resp == nil {
+		service.ResponseError(fmt.Errorf("empty response from bedrock"), writer)
+		return
+	}
+	result := responseReq.NewResponse()
+	FillOpenAIResponse(result, responseReq.IsForcedFormat(), resp)
+	onComplete(result)
+	service.ResponseJSON(result, writer)
+}
+
+// retrieve or delete a stored response
+func (service *HTTPService) HandleStoredResponse(writer http.ResponseWriter, request *http.Request) {
+	responseId := mux.Vars(request)["response_id"]
+	switch request.Method {
+	case "GET":
+		stored := service.responses.Get(responseId)
+		if stored == nil {
+			service.ResponseAPIError(ErrorTypeNotFound, http.StatusNotFound, fmt.Errorf("response not found: %s", responseId), writer)
+			return
+		}
+		service.ResponseJSON(stored.Response, writer)
+	case "DELETE":
+		if !service.responses.Delete(responseId) {
+			service.ResponseAPIError(ErrorTypeNotFound, http.StatusNotFound, fmt.Errorf("response not found: %s", responseId), writer)
+			return
+		}
+		service.ResponseJSON(&OpenAIResponseDeleted{Id: responseId, Object: "response.deleted", Deleted: true}, writer)
+	default:
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+	}
+}
+
+// batch manager, or the reason it is not available
+func (service *HTTPService) GetBatchManager() (*BatchManager, error) {
+	if service.batches == nil {
+		return nil, &ClaudeAPIError{
+			Type:       ErrorTypeAPI,
+			StatusCode: http.StatusServiceUnavailable,
+			Message:    fmt.Sprintf("message batches are not available, %v", service.batchErr),
+			Err:        service.batchErr,
+		}
+	}
+	return service.batches, nil
+}
+
+// results_url of batch relative to the request host
+func (service *HTTPService) absoluteBatch(batch *MessageBatch, request *http.Request) *MessageBatch {
+	if batch.ResultsUrl == nil || batch.ProcessingStatus != BatchStatusEnded {
+		batch.ResultsUrl = nil
+		return batch
+	}
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if forwarded := request.Header.Get("X-Forwarded-Proto"); len(forwarded) > 0 {
+		scheme = forwarded
+	}
+	resultsUrl := fmt.Sprintf("%s://%s%s", scheme, request.Host, *batch.ResultsUrl)
+	batch.ResultsUrl = &resultsUrl
+	return batch
+}
+
+// create or list message batches
+func (service *HTTPService) HandleMessageBatches(writer http.ResponseWriter, request *http.Request) {
+	batches, err := service.GetBatchManager()
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+
+	switch request.Method {
+	case "POST":
+		if !strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+			service.ResponseError(NewInvalidRequestError(fmt.Errorf("invalid content type")), writer)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(request.Body, maxBatchBodySize+1))
+		if err != nil {
+			service.ResponseError(NewInvalidRequestError(fmt.Errorf("error reading request body")), writer)
+			return
+		}
+		defer request.Body.Close()
+		if len(body) > maxBatchBodySize {
+			service.ResponseAPIError(ErrorTypeRequestTooLarge, http.StatusRequestEntityTooLarge, fmt.Errorf("batch exceeds %d bytes", maxBatchBodySize), writer)
+			return
+		}
+
+		var req MessageBatchCreateRequest
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			service.ResponseError(NewInvalidRequestError(err), writer)
+			return
+		}
+		batch, err := batches.Create(&req)
+		if err != nil {
+			service.ResponseError(err, writer)
+			return
+		}
+		service.ResponseJSON(service.absoluteBatch(batch, request), writer)
+	case "GET":
+		query := request.URL.Query()
+		limit := 0
+		if len(query.Get("limit")) > 0 {
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil {
+				service.ResponseError(NewInvalidRequestError(fmt.Errorf("invalid limit")), writer)
+				return
+			}
+		}
+		list, err := batches.List(query.Get("after_id"), query.Get("before_id"), limit)
+		if err != nil {
+			service.ResponseError(err, writer)
+			return
+		}
+		for _, batch := range list.Data {
+			service.absoluteBatch(batch, request)
+		}
+		service.ResponseJSON(list, writer)
+	default:
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+	}
+}
+
+// retrieve or delete a message batch
+func (service *HTTPService) HandleMessageBatch(writer http.ResponseWriter, request *http.Request) {
+	batches, err := service.GetBatchManager()
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+
+	batchId := mux.Vars(request)["batch_id"]
+	switch request.Method {
+	case "GET":
+		batch, err := batches.Get(batchId)
+		if err != nil {
+			service.ResponseError(err, writer)
+			return
+		}
+		service.ResponseJSON(service.absoluteBatch(batch, request), writer)
+	case "DELETE":
+		deleted, err := batches.Delete(batchId)
+		if err != nil {
+			service.ResponseError(err, writer)
+			return
+		}
+		service.ResponseJSON(deleted, writer)
+	default:
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+	}
+}
+
+func (service *HTTPService) HandleCancelMessageBatch(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+		return
+	}
+	batches, err := service.GetBatchManager()
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	batch, err := batches.Cancel(mux.Vars(request)["batch_id"])
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	service.ResponseJSON(service.absoluteBatch(batch, request), writer)
+}
+
+// results of an ended batch as jsonl
+func (service *HTTPService) HandleMessageBatchResults(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		service.ResponseAPIError(ErrorTypeInvalidRequest, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"), writer)
+		return
+	}
+	batches, err := service.GetBatchManager()
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	path, err := batches.ResultsPath(mux.Vars(request)["batch_id"])
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		service.ResponseError(err, writer)
+		return
+	}
+	defer file.Close()
+	writer.Header().Set("Content-Type", "application/x-jsonl")
+	io.Copy(writer, file)
+}
+
 // APIKeyMiddleware 验证 API Key 的中间件
 func (service *HTTPService) APIKeyMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
@@ -211,16 +695,20 @@ func (service *HTTPService) APIKeyMiddleware(next http.Handler) http.Handler {
 			return
 		}
 		apiKey := request.Header.Get("x-api-key")
+		// openai clients send the key as bearer token
+		if apiKey == "" {
+			apiKey = strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		}
 
 		if apiKey == "" {
-			service.ResponseError(fmt.Errorf("empty api key"), writer)
+			service.ResponseAPIError(ErrorTypeAuthentication, http.StatusUnauthorized, fmt.Errorf("empty api key"), writer)
 			return
 		}
 
 		// 这里可以添加更多的 API Key 验证逻辑
 		if apiKey != APIKey {
 			Log.Debugf("Invalid API key in header: %s", apiKey)
-			service.ResponseError(fmt.Errorf("invalid api key"), writer)
+			service.ResponseAPIError(ErrorTypeAuthentication, http.StatusUnauthorized, fmt.Errorf("invalid api key"), writer)
 			return
 		}
 
@@ -237,8 +725,20 @@ func (service *HTTPService) Start() {
 
 	apiRouter.HandleFunc("/complete", service.HandleComplete)
 	apiRouter.HandleFunc("/messages", service.HandleMessageComplete)
+	apiRouter.HandleFunc("/messages/count_tokens", service.HandleCountTokens)
+	apiRouter.HandleFunc("/messages/batches", service.HandleMessageBatches)
+	apiRouter.HandleFunc("/messages/batches/{batch_id}", service.HandleMessageBatch)
+	apiRouter.HandleFunc("/messages/batches/{batch_id}/cancel", service.HandleCancelMessageBatch)
+	apiRouter.HandleFunc("/messages/batches/{batch_id}/results", service.HandleMessageBatchResults)
+	apiRouter.HandleFunc("/models", service.HandleListModels)
+	apiRouter.HandleFunc("/models/{model_id}", service.HandleGetModel)
+	apiRouter.HandleFunc("/chat/completions", service.HandleChatCompletions)
+	apiRouter.HandleFunc("/responses", service.HandleResponses)
+	apiRouter.HandleFunc("/responses/{response_id}", service.HandleStoredResponse)
 
 	rHandler.HandleFunc("/swagger", service.RedirectSwagger)
+	// metrics need the api key too
+	rHandler.Handle("/debug/vars", service.APIKeyMiddleware(expvar.Handler()))
 	rHandler.PathPrefix("/").Handler(http.StripPrefix("/",
 		http.FileServer(http.Dir(service.conf.WebRoot))))
 	rHandler.NotFoundHandler = http.HandlerFunc(service.NotFoundHandle)
@@ -0,0 +1,15 @@
+package pkg
+
+import (
+	"expvar"
+)
+
+// ---------------------
+// metrics, exposed by expvar at /debug/vars
+// ---------------------
+var Metrics = expvar.NewMap("bedrock_proxy")
+
+// increase counter by one
+func CountMetric(name string) {
+	Metrics.Add(name, 1)
+}
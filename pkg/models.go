@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---------------------
+// models api
+// ---------------------
+// model object
+type ClaudeModelInfo struct {
+	Type        string `json:"type"`
+	Id          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// paginated model list
+type ClaudeModelList struct {
+	Data    []*ClaudeModelInfo `json:"data"`
+	HasMore bool               `json:"has_more"`
+	FirstId *string            `json:"first_id"`
+	LastId  *string            `json:"last_id"`
+}
+
+// page size of model list
+const (
+	defaultModelListLimit = 20
+	maxModelListLimit     = 1000
+)
+
+// release date in model ids, e.g. claude-3-5-sonnet-20241022
+var modelDateRegexp = regexp.MustCompile(`\d{8}`)
+
+func NewClaudeModelInfo(alias string, modelId string) *ClaudeModelInfo {
+	createdAt := time.Unix(0, 0).UTC()
+	for _, id := range []string{alias, modelId} {
+		date, err := time.Parse("20060102", modelDateRegexp.FindString(id))
+		if err == nil {
+			createdAt = date
+			break
+		}
+	}
+
+	return &ClaudeModelInfo{
+		Type:        "model",
+		Id:          alias,
+		DisplayName: modelDisplayName(alias),
+		CreatedAt:   createdAt.Format(time.RFC3339),
+	}
+}
+
+// claude-3-5-sonnet-20241022 => Claude 3.5 Sonnet
+func modelDisplayName(id string) string {
+	words := []string{}
+	lastIsNumber := false
+	for _, part := range strings.Split(id, "-") {
+		if len(part) == 0 || modelDateRegexp.MatchString(part) {
+			continue
+		}
+		isNumber := strings.Trim(part, "0123456789") == ""
+		if isNumber && lastIsNumber {
+			words[len(words)-1] += "." + part
+			continue
+		}
+		words = append(words, strings.ToUpper(part[:1])+part[1:])
+		lastIsNumber = isNumber
+	}
+	return strings.Join(words, " ")
+}
+
+// aliases served by the proxy: model mappings, mappings of router targets and failover models,
+// same as resolved by the router. the first mapping of an alias wins
+func (config *BedrockConfig) ServedModelMappings() map[string]ModelChain {
+	mappings := map[string]ModelChain{}
+	add := func(alias string, chain ModelChain) {
+		if _, exist := mappings[alias]; !exist && len(chain) > 0 {
+			mappings[alias] = chain
+		}
+	}
+	for alias, chain := range config.ModelMappings {
+		add(alias, chain)
+	}
+	for _, target := range config.Targets {
+		for alias, chain := range target.ModelMappings {
+			add(alias, chain)
+		}
+	}
+	// failover models are also keyed by bedrock model ids, only aliases are listed
+	for model, failover := range config.Retry.getFailoverModels() {
+		if !strings.Contains(model, ".") {
+			add(model, ModelChain{failover})
+		}
+	}
+	return mappings
+}
+
+// all aliases served by the proxy, newest first
+func (config *BedrockConfig) GetModels() []*ClaudeModelInfo {
+	models := []*ClaudeModelInfo{}
+	for alias, chain := range config.ServedModelMappings() {
+		models = append(models, NewClaudeModelInfo(alias, chain.First()))
+	}
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].CreatedAt != models[j].CreatedAt {
+			return models[i].CreatedAt > models[j].CreatedAt
+		}
+		return models[i].Id < models[j].Id
+	})
+	return models
+}
+
+// model of alias, nil if not found
+func (config *BedrockConfig) GetModel(alias string) *ClaudeModelInfo {
+	chain, exist := config.ServedModelMappings()[alias]
+	if !exist {
+		return nil
+	}
+	return NewClaudeModelInfo(alias, chain.First())
+}
+
+// one page of models, after_id and before_id are exclusive
+func (config *BedrockConfig) ListModels(afterId string, beforeId string, limit int) (*ClaudeModelList, error) {
+	models := config.GetModels()
+	indexOf := func(id string) (int, error) {
+		for i, model := range models {
+			if model.Id == id {
+				return i, nil
+			}
+		}
+		return -1, &ClaudeAPIError{
+			Type:       ErrorTypeNotFound,
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("model: %s", id),
+		}
+	}
+
+	start, end, hasMore, err := listPage(len(models), indexOf, afterId, beforeId, limit, defaultModelListLimit, maxModelListLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &ClaudeModelList{
+		Data:    models[start:end],
+		HasMore: hasMore,
+	}
+	if len(list.Data) > 0 {
+		list.FirstId = &list.Data[0].Id
+		list.LastId = &list.Data[len(list.Data)-1].Id
+	}
+	return list, nil
+}
+
+// start and end of one page of a list of count items, after_id and before_id are exclusive.
+// indexOf finds the index of an id, hasMore is true if the list goes on in the paging direction
+func listPage(count int, indexOf func(id string) (int, error), afterId string, beforeId string, limit int, defaultLimit int, maxLimit int) (int, int, bool, error) {
+	if limit == 0 {
+		limit = defaultLimit
+	}
+	if limit < 1 || limit > maxLimit {
+		return 0, 0, false, NewInvalidRequestError(fmt.Errorf("limit must be between 1 and %d", maxLimit))
+	}
+
+	start, end := 0, count
+	hasMore := false
+	switch {
+	case len(beforeId) > 0:
+		index, err := indexOf(beforeId)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		end = index
+		if end-limit > 0 {
+			start = end - limit
+			hasMore = true
+		}
+	default:
+		if len(afterId) > 0 {
+			index, err := indexOf(afterId)
+			if err != nil {
+				return 0, 0, false, err
+			}
+			start = index + 1
+		}
+		if start+limit < end {
+			end = start + limit
+			hasMore = true
+		}
+	}
+	return start, end, hasMore, nil
+}
@@ -0,0 +1,890 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ---------------------
+// openai chat completions api
+// ---------------------
+// request.messages[]
+type OpenAIChatMessage struct {
+	Role       string            `json:"role"`
+	Content    json.RawMessage   `json:"content,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	ToolCalls  []*OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallId string            `json:"tool_call_id,omitempty"`
+}
+
+// request.messages[].content[]
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageUrl *OpenAIImageUrl `json:"image_url,omitempty"`
+}
+
+type OpenAIImageUrl struct {
+	Url    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// request.tools[]
+type OpenAITool struct {
+	Type     string          `json:"type"`
+	Function *OpenAIFunction `json:"function,omitempty"`
+}
+
+type OpenAIFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// request.messages[].tool_calls[], response.choices[].message.tool_calls[]
+type OpenAIToolCall struct {
+	Index    *int                `json:"index,omitempty"`
+	Id       string              `json:"id,omitempty"`
+	Type     string              `json:"type,omitempty"`
+	Function *OpenAIFunctionCall `json:"function,omitempty"`
+}
+
+type OpenAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// request.response_format
+type OpenAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JsonSchema *OpenAIJsonSchema `json:"json_schema,omitempty"`
+}
+
+type OpenAIJsonSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// request.stream_options
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"`
+}
+
+// request
+type OpenAIChatCompletionRequest struct {
+	Model               string                `json:"model"`
+	Messages            []*OpenAIChatMessage  `json:"messages"`
+	MaxTokens           int                   `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                   `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64              `json:"temperature,omitempty"`
+	TopP                float64               `json:"top_p,omitempty"`
+	N                   int                   `json:"n,omitempty"`
+	Stop                json.RawMessage       `json:"stop,omitempty"`
+	Stream              bool                  `json:"stream,omitempty"`
+	StreamOptions       *OpenAIStreamOptions  `json:"stream_options,omitempty"`
+	Tools               []*OpenAITool         `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage       `json:"tool_choice,omitempty"`
+	ParallelToolCalls   *bool                 `json:"parallel_tool_calls,omitempty"`
+	ResponseFormat      *OpenAIResponseFormat `json:"response_format,omitempty"`
+	ReasoningEffort     string                `json:"reasoning_effort,omitempty"`
+	User                string                `json:"user,omitempty"`
+}
+
+// response.usage
+type OpenAIUsage struct {
+	PromptTokens        int                        `json:"prompt_tokens"`
+	CompletionTokens    int                        `json:"completion_tokens"`
+	TotalTokens         int                        `json:"total_tokens"`
+	PromptTokensDetails *OpenAIPromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+// response.usage.prompt_tokens_details
+type OpenAIPromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+// openai usage of claude usage, openai prompt tokens include the cached ones
+func newOpenAIUsage(usage *ClaudeMessageUsage) *OpenAIUsage {
+	promptTokens := usage.TotalInputTokens()
+	return &OpenAIUsage{
+		PromptTokens:        promptTokens,
+		CompletionTokens:    usage.OutputTokens,
+		TotalTokens:         promptTokens + usage.OutputTokens,
+		PromptTokensDetails: &OpenAIPromptTokensDetails{CachedTokens: usage.CacheReadInputTokens},
+	}
+}
+
+// response.choices[].message, chunk.choices[].delta
+type OpenAIResponseMessage struct {
+	Role    string  `json:"role,omitempty"`
+	Content *string `json:"content,omitempty"`
+	// claude thinking, the signature can not be sent back in openai messages
+	ReasoningContent string            `json:"reasoning_content,omitempty"`
+	ToolCalls        []*OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// response.choices[]
+type OpenAIChoice struct {
+	Index        int                    `json:"index"`
+	Message      *OpenAIResponseMessage `json:"message,omitempty"`
+	Delta        *OpenAIResponseMessage `json:"delta,omitempty"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+// response, chunk
+type OpenAIChatCompletionResponse struct {
+	Id      string          `json:"id"`
+	Object  string          `json:"object"`
+	Created int64           `json:"created"`
+	Model   string          `json:"model"`
+	Choices []*OpenAIChoice `json:"choices"`
+	Usage   *OpenAIUsage    `json:"usage,omitempty"`
+}
+
+// sse chunk, openai streams have no event name
+type OpenAIStreamEvent struct {
+	Data []byte
+}
+
+func (event *OpenAIStreamEvent) GetBytes() []byte {
+	return event.Data
+}
+
+func (event *OpenAIStreamEvent) GetEvent() string {
+	return ""
+}
+
+func (event *OpenAIStreamEvent) GetText() string {
+	return ""
+}
+
+// keep-alive of openai streams, a SSE comment ignored by clients
+var openAIPingFrame = []byte(": ping\n\n")
+
+// default max_tokens, openai requests may omit it but claude requires it
+const openAIDefaultMaxTokens = 4096
+
+// tool used to force a json_schema response_format
+const openAIResponseFormatTool = "json_response"
+
+// openai reasoning effort => claude thinking budget_tokens
+var openAIReasoningBudgets = map[string]int{
+	"minimal": 1024,
+	"low":     2048,
+	"medium":  8192,
+	"high":    24576,
+}
+
+// min budget_tokens of claude thinking
+const minThinkingBudget = 1024
+
+// max size of images downloaded for image_url parts
+const maxImageSize = 20 << 20
+
+// max redirects followed while downloading images
+const maxImageRedirects = 5
+
+// client downloading images of client supplied urls. it only connects to public addresses,
+// so urls can not reach the proxy host, its network or the instance metadata service.
+// every connection goes through the dialer, including the ones of redirects
+var imageHTTPClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		// no proxy from environment, the dialer must see the address of the image host
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkImageAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	},
+	CheckRedirect: func(request *http.Request, via []*http.Request) error {
+		if len(via) >= maxImageRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxImageRedirects)
+		}
+		if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+			return fmt.Errorf("invalid redirect url")
+		}
+		return nil
+	},
+}
+
+var errImageAddress = errors.New("image url must resolve to a public address")
+
+// reject loopback, private, link-local, multicast and unspecified addresses
+func checkImageAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errImageAddress
+	}
+	return nil
+}
+
+// shared address space of carrier-grade nat, not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// convert to claude message request
+func (request *OpenAIChatCompletionRequest) ToClaudeRequest(ctx context.Context) (*ClaudeMessageCompletionRequest, error) {
+	if request.N > 1 {
+		return nil, NewInvalidRequestError(fmt.Errorf("n > 1 is not supported"))
+	}
+
+	maxTokens := request.MaxCompletionTokens
+	if maxTokens <= 0 {
+		maxTokens = request.MaxTokens
+	}
+	req := newOpenAIClaudeRequest(request.Model, request.Stream, maxTokens, request.Temperature, request.TopP, request.User)
+
+	stop, err := parseOpenAIStop(request.Stop)
+	if err != nil {
+		return nil, err
+	}
+	req.StopSequences = stop
+
+	systems := []string{}
+	for _, message := range request.Messages {
+		switch message.Role {
+		case "system", "developer":
+			text, err := openAIContentText(message.Content)
+			if err != nil {
+				return nil, err
+			}
+			systems = append(systems, text)
+		case "user":
+			blocks, err := openAIContentBlocks(ctx, message.Content)
+			if err != nil {
+				return nil, err
+			}
+			appendClaudeMessage(req, "user", blocks)
+		case "assistant":
+			text, err := openAIContentText(message.Content)
+			if err != nil {
+				return nil, err
+			}
+			blocks := []*ClaudeMessageRequestContent{}
+			if len(text) > 0 {
+				blocks = append(blocks, &ClaudeMessageRequestContent{Type: "text", Text: text})
+			}
+			for _, toolCall := range message.ToolCalls {
+				if toolCall.Function == nil {
+					continue
+				}
+				blocks = append(blocks, newToolUseBlock(toolCall.Id, toolCall.Function.Name, toolCall.Function.Arguments))
+			}
+			appendClaudeMessage(req, "assistant", blocks)
+		case "tool", "function":
+			text, err := openAIContentText(message.Content)
+			if err != nil {
+				return nil, err
+			}
+			content, _ := json.Marshal(text)
+			appendClaudeMessage(req, "user", []*ClaudeMessageRequestContent{{
+				Type:      "tool_result",
+				ToolUseId: message.ToolCallId,
+				Content:   content,
+			}})
+		default:
+			return nil, NewInvalidRequestError(fmt.Errorf("unknown message role: %s", message.Role))
+		}
+	}
+
+	for _, tool := range request.Tools {
+		if tool.Type != "function" || tool.Function == nil {
+			return nil, NewInvalidRequestError(fmt.Errorf("unsupported tool type: %s", tool.Type))
+		}
+		claudeTool, err := newClaudeTool(tool.Function.Name, tool.Function.Description, tool.Function.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		req.Tools = append(req.Tools, claudeTool)
+	}
+
+	toolChoice, err := parseOpenAIToolChoice(request.ToolChoice)
+	if err != nil {
+		return nil, err
+	}
+	setOpenAIToolChoice(req, toolChoice, request.ParallelToolCalls)
+
+	if format := request.ResponseFormat; format != nil {
+		schema := format.JsonSchema
+		if format.Type == "json_schema" && schema == nil {
+			return nil, NewInvalidRequestError(fmt.Errorf("response_format.json_schema is required"))
+		}
+		if schema == nil {
+			schema = &OpenAIJsonSchema{}
+		}
+		systems, err = setOpenAIResponseFormat(req, systems, format.Type, schema.Description, schema.Schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+	setOpenAISystem(req, systems)
+
+	err = setOpenAIReasoning(req, request.ReasoningEffort, request.MaxCompletionTokens > 0 || request.MaxTokens > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// claude request of the fields shared by chat completions and responses requests
+func newOpenAIClaudeRequest(model string, stream bool, maxTokens int, temperature *float64, topP float64, user string) *ClaudeMessageCompletionRequest {
+	req := &ClaudeMessageCompletionRequest{
+		Model:       model,
+		Stream:      stream,
+		MaxToken:    maxTokens,
+		Temperature: claudeTemperature(temperature),
+		TopP:        topP,
+	}
+	if req.MaxToken <= 0 {
+		req.MaxToken = openAIDefaultMaxTokens
+	}
+	if len(user) > 0 {
+		req.Metadata = &ClaudeMessageCompletionRequestMetadata{UserId: user}
+	}
+	return req
+}
+
+// tool_use block of a function call, arguments that are not valid json become an empty input
+func newToolUseBlock(id string, name string, arguments string) *ClaudeMessageRequestContent {
+	input := json.RawMessage(arguments)
+	if !json.Valid(input) {
+		input = json.RawMessage("{}")
+	}
+	return &ClaudeMessageRequestContent{
+		Type:  "tool_use",
+		Id:    id,
+		Name:  name,
+		Input: input,
+	}
+}
+
+// image block of data url or http url
+func newImageBlock(ctx context.Context, url string) (*ClaudeMessageRequestContent, error) {
+	source, err := loadImageSource(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return &ClaudeMessageRequestContent{Type: "image", Source: source}, nil
+}
+
+// tool_choice and parallel_tool_calls, tool_choice is not allowed without tools
+func setOpenAIToolChoice(req *ClaudeMessageCompletionRequest, toolChoice *ClaudeMessageToolChoice, parallelToolCalls *bool) {
+	if len(req.Tools) == 0 {
+		return
+	}
+	if parallelToolCalls != nil && !*parallelToolCalls {
+		if toolChoice == nil {
+			toolChoice = &ClaudeMessageToolChoice{Type: "auto"}
+		}
+		toolChoice.DisableParallelToolUse = true
+	}
+	req.ToolChoice = toolChoice
+}
+
+// json_object asks for json in the system prompt, json_schema forces a tool call whose input is the response.
+// returns systems with the instruction added
+func setOpenAIResponseFormat(req *ClaudeMessageCompletionRequest, systems []string, formatType string, description string, schema json.RawMessage) ([]string, error) {
+	switch formatType {
+	case "json_object":
+		systems = append(systems, "Respond only with a valid JSON object.")
+	case "json_schema":
+		claudeTool, err := newClaudeTool(openAIResponseFormatTool, description, schema)
+		if err != nil {
+			return nil, err
+		}
+		req.Tools = append(req.Tools, claudeTool)
+		req.ToolChoice = &ClaudeMessageToolChoice{Type: "tool", Name: openAIResponseFormatTool}
+	}
+	return systems, nil
+}
+
+// system prompt of openai system / developer messages and instructions
+func setOpenAISystem(req *ClaudeMessageCompletionRequest, systems []string) {
+	if len(systems) > 0 {
+		req.System, _ = json.Marshal(strings.Join(systems, "\n\n"))
+	}
+}
+
+// claude tool of function definition
+func newClaudeTool(name string, description string, parameters json.RawMessage) (*ClaudeMessageCompletionRequestTools, error) {
+	schema := emptyInputSchema
+	if len(parameters) > 0 && string(parameters) != "null" {
+		// type of parameters is object if omitted
+		var object map[string]json.RawMessage
+		err := json.Unmarshal(parameters, &object)
+		if err != nil {
+			return nil, NewInvalidRequestError(fmt.Errorf("invalid parameters of function %s, %v", name, err))
+		}
+		schema = parameters
+		if _, exist := object["type"]; !exist {
+			object["type"] = json.RawMessage(`"object"`)
+			schema, _ = json.Marshal(object)
+		}
+	}
+	err := validateInputSchema("parameters", schema)
+	if err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid parameters of function %s, %v", name, err))
+	}
+	return &ClaudeMessageCompletionRequestTools{
+		Name:        name,
+		Description: description,
+		InputSchema: schema,
+	}, nil
+}
+
+// enable claude thinking for openai reasoning effort. max_tokens of claude includes the budget,
+// it is raised if the client did not set it, otherwise the budget is cut to fit
+func setOpenAIReasoning(req *ClaudeMessageCompletionRequest, effort string, maxTokensSet bool) error {
+	if len(effort) == 0 || effort == "none" {
+		return nil
+	}
+	budget, exist := openAIReasoningBudgets[effort]
+	if !exist {
+		return NewInvalidRequestError(fmt.Errorf("unsupported reasoning effort: %s", effort))
+	}
+	if budget >= req.MaxToken {
+		if maxTokensSet {
+			budget = req.MaxToken / 2
+		} else {
+			req.MaxToken = budget + openAIDefaultMaxTokens
+		}
+	}
+	if budget < minThinkingBudget {
+		return NewInvalidRequestError(fmt.Errorf("max tokens must be at least %d with reasoning effort %s", 2*minThinkingBudget, effort))
+	}
+	// claude requires the thinking block before tool_use of the last assistant turn,
+	// openai messages can not carry it with the signature
+	if lastToolUseWithoutThinking(req) {
+		Log.Debugf("thinking is disabled, the last assistant tool call has no thinking block")
+		return nil
+	}
+	req.Thinking = &ClaudeThinkingConfig{Type: "enabled", BudgetTokens: budget}
+
+	// thinking is not compatible with temperature, top_p or forced tool use
+	req.Temperature = nil
+	req.TopP = 0
+	if req.ToolChoice != nil && (req.ToolChoice.Type == "any" || req.ToolChoice.Type == "tool") {
+		req.ToolChoice.Type = "auto"
+		req.ToolChoice.Name = ""
+	}
+	return nil
+}
+
+// the last assistant message calls tools without a thinking block
+func lastToolUseWithoutThinking(req *ClaudeMessageCompletionRequest) bool {
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role != "assistant" {
+			continue
+		}
+		blocks, err := parseMessageContent(req.Messages[i].Content)
+		if err != nil {
+			return false
+		}
+		toolUse, thinking := false, false
+		for _, block := range blocks {
+			switch block.Type {
+			case "tool_use":
+				toolUse = true
+			case "thinking", "redacted_thinking":
+				thinking = true
+			}
+		}
+		return toolUse && !thinking
+	}
+	return false
+}
+
+// merge blocks into the last message if it has the same role, claude requires alternate roles
+func appendClaudeMessage(req *ClaudeMessageCompletionRequest, role string, blocks []*ClaudeMessageRequestContent) {
+	if len(blocks) == 0 {
+		return
+	}
+	if len(req.Messages) > 0 {
+		last := req.Messages[len(req.Messages)-1]
+		if last.Role == role {
+			var lastBlocks []*ClaudeMessageRequestContent
+			if json.Unmarshal(last.Content, &lastBlocks) == nil {
+				last.Content, _ = json.Marshal(append(lastBlocks, blocks...))
+				return
+			}
+		}
+	}
+	content, _ := json.Marshal(blocks)
+	req.Messages = append(req.Messages, &ClaudeMessageCompletionRequestMessage{
+		Role:    role,
+		Content: content,
+	})
+}
+
+// stop is a string or an array of string
+func parseOpenAIStop(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var stop string
+	if json.Unmarshal(raw, &stop) == nil {
+		return []string{stop}, nil
+	}
+	var stops []string
+	if err := json.Unmarshal(raw, &stops); err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid stop, %v", err))
+	}
+	return stops, nil
+}
+
+// tool_choice is none / auto / required or {"type": "function", "function": {"name": ...}}
+func parseOpenAIToolChoice(raw json.RawMessage) (*ClaudeMessageToolChoice, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var mode string
+	if json.Unmarshal(raw, &mode) == nil {
+		switch mode {
+		case "none":
+			return &ClaudeMessageToolChoice{Type: "none"}, nil
+		case "auto":
+			return &ClaudeMessageToolChoice{Type: "auto"}, nil
+		case "required":
+			return &ClaudeMessageToolChoice{Type: "any"}, nil
+		}
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid tool_choice: %s", mode))
+	}
+	var choice OpenAITool
+	if err := json.Unmarshal(raw, &choice); err != nil || choice.Function == nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid tool_choice"))
+	}
+	return &ClaudeMessageToolChoice{Type: "tool", Name: choice.Function.Name}, nil
+}
+
+// content is a string or an array of parts
+func openAIContentParts(raw json.RawMessage) ([]*OpenAIContentPart, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []*OpenAIContentPart{{Type: "text", Text: text}}, nil
+	}
+	var parts []*OpenAIContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid message content, %v", err))
+	}
+	return parts, nil
+}
+
+// text of content, non-text parts are not allowed
+func openAIContentText(raw json.RawMessage) (string, error) {
+	parts, err := openAIContentParts(raw)
+	if err != nil {
+		return "", err
+	}
+	texts := []string{}
+	for _, part := range parts {
+		if part.Type != "text" {
+			return "", NewInvalidRequestError(fmt.Errorf("unsupported content type %s for this role", part.Type))
+		}
+		texts = append(texts, part.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// claude content blocks of user content
+func openAIContentBlocks(ctx context.Context, raw json.RawMessage) ([]*ClaudeMessageRequestContent, error) {
+	parts, err := openAIContentParts(raw)
+	if err != nil {
+		return nil, err
+	}
+	blocks := []*ClaudeMessageRequestContent{}
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			blocks = append(blocks, &ClaudeMessageRequestContent{Type: "text", Text: part.Text})
+		case "image_url":
+			if part.ImageUrl == nil {
+				return nil, NewInvalidRequestError(fmt.Errorf("image_url is required"))
+			}
+			block, err := newImageBlock(ctx, part.ImageUrl.Url)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		default:
+			return nil, NewInvalidRequestError(fmt.Errorf("unsupported content type: %s", part.Type))
+		}
+	}
+	return blocks, nil
+}
+
+// openai temperature is 0~2, claude is 0~1. an explicit 0 is kept
+func claudeTemperature(temperature *float64) *float64 {
+	if temperature == nil {
+		return nil
+	}
+	value := math.Min(*temperature, 1)
+	return &value
+}
+
+// base64 image source of data url, or download the http url since bedrock only accepts base64
+func loadImageSource(ctx context.Context, url string) (*ClaudeMessageContentSource, error) {
+	if strings.HasPrefix(url, "data:") {
+		// data:image/png;base64,xxxx
+		meta, data, found := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+		mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+		if !found || !isBase64 {
+			return nil, NewInvalidRequestError(fmt.Errorf("image data url must be base64 encoded"))
+		}
+		return &ClaudeMessageContentSource{Type: "base64", MediaType: mediaType, Data: data}, nil
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid image url"))
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, NewInvalidRequestError(err)
+	}
+	response, err := imageHTTPClient.Do(httpRequest)
+	if err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("unable to download image, %v", err))
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, NewInvalidRequestError(fmt.Errorf("unable to download image, status %d", response.StatusCode))
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxImageSize+1))
+	if err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("unable to download image, %v", err))
+	}
+	if len(data) > maxImageSize {
+		return nil, NewInvalidRequestError(fmt.Errorf("image is larger than %d bytes", maxImageSize))
+	}
+	mediaType := response.Header.Get("Content-Type")
+	if !strings.HasPrefix(mediaType, "image/") {
+		mediaType = http.DetectContentType(data)
+	}
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	return &ClaudeMessageContentSource{
+		Type:      "base64",
+		MediaType: mediaType,
+		Data:      base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+// claude stop_reason => openai finish_reason
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// convert claude message response
+func NewOpenAIChatCompletionResponse(model string, forcedFormat bool, resp *ClaudeMessageCompletionResponse) *OpenAIChatCompletionResponse {
+	message := &OpenAIResponseMessage{Role: "assistant"}
+	text := ""
+	finishReason := openAIFinishReason(resp.StopReason)
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text += block.Text
+		case "thinking":
+			message.ReasoningContent += block.Thinking
+		case "tool_use":
+			arguments, _ := json.Marshal(block.Input)
+			if forcedFormat && block.Name == openAIResponseFormatTool {
+				text += string(arguments)
+				finishReason = "stop"
+				continue
+			}
+			message.ToolCalls = append(message.ToolCalls, &OpenAIToolCall{
+				Id:   block.Id,
+				Type: "function",
+				Function: &OpenAIFunctionCall{
+					Name:      block.Name,
+					Arguments: string(arguments),
+				},
+			})
+		}
+	}
+	if len(text) > 0 || len(message.ToolCalls) == 0 {
+		message.Content = &text
+	}
+
+	response := &OpenAIChatCompletionResponse{
+		Id:      "chatcmpl-" + resp.Id,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []*OpenAIChoice{{
+			Index:        0,
+			Message:      message,
+			FinishReason: &finishReason,
+		}},
+	}
+	if resp.Usage != nil {
+		response.Usage = newOpenAIUsage(resp.Usage)
+	}
+	return response
+}
+
+// convert claude sse events to openai chat.completion.chunk events, end with [DONE]
+func NewOpenAIChatCompletionStream(ctx context.Context, model string, forcedFormat bool, includeUsage bool, queue <-chan ISSEDecoder) <-chan ISSEDecoder {
+	chunkQueue := make(chan ISSEDecoder, streamQueueSize)
+
+	go func() {
+		defer close(chunkQueue)
+
+		id := ""
+		created := time.Now().Unix()
+		usage := &ClaudeMessageUsage{}
+		// claude content block index => openai tool call index, -1 for the forced format tool
+		toolIndexes := map[int]int{}
+		toolCount := 0
+
+		send := func(data interface{}) bool {
+			raw, _ := json.Marshal(data)
+			select {
+			case chunkQueue <- &OpenAIStreamEvent{Data: raw}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		chunk := func(delta *OpenAIResponseMessage, finishReason *string) *OpenAIChatCompletionResponse {
+			return &OpenAIChatCompletionResponse{
+				Id:      id,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   model,
+				Choices: []*OpenAIChoice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+			}
+		}
+		textDelta := func(text string) *OpenAIResponseMessage {
+			return &OpenAIResponseMessage{Content: &text}
+		}
+
+		for event := range queue {
+			var data interface{}
+			switch v := event.(type) {
+			case *SSEErrorEvent:
+				data = map[string]interface{}{"error": &APIError{Type: v.Error.Type, Message: v.Error.Message}}
+			case *ClaudeMessageCompletionStreamEvent:
+				switch v.Type {
+				case "message_start":
+					if v.Message != nil {
+						id = "chatcmpl-" + v.Message.Id
+						mergeUsage(usage, v.Message.Usage)
+					}
+					data = chunk(&OpenAIResponseMessage{Role: "assistant", Content: new(string)}, nil)
+				case "content_block_start":
+					if v.ContentBlock == nil || v.ContentBlock.Type != "tool_use" {
+						continue
+					}
+					if forcedFormat && v.ContentBlock.Name == openAIResponseFormatTool {
+						toolIndexes[v.Index] = -1
+						continue
+					}
+					index := toolCount
+					toolCount++
+					toolIndexes[v.Index] = index
+					data = chunk(&OpenAIResponseMessage{ToolCalls: []*OpenAIToolCall{{
+						Index:    &index,
+						Id:       v.ContentBlock.Id,
+						Type:     "function",
+						Function: &OpenAIFunctionCall{Name: v.ContentBlock.Name},
+					}}}, nil)
+				case "content_block_delta":
+					if v.Delta == nil {
+						continue
+					}
+					switch v.Delta.Type {
+					case "text_delta":
+						data = chunk(textDelta(v.Delta.Text), nil)
+					case "thinking_delta":
+						data = chunk(&OpenAIResponseMessage{ReasoningContent: v.Delta.Thinking}, nil)
+					case "input_json_delta":
+						index, exist := toolIndexes[v.Index]
+						if !exist {
+							continue
+						}
+						if index < 0 {
+							data = chunk(textDelta(v.Delta.PartialJson), nil)
+							break
+						}
+						data = chunk(&OpenAIResponseMessage{ToolCalls: []*OpenAIToolCall{{
+							Index:    &index,
+							Function: &OpenAIFunctionCall{Arguments: v.Delta.PartialJson},
+						}}}, nil)
+					default:
+						continue
+					}
+				case "message_delta":
+					mergeUsage(usage, v.Usage)
+					if v.Delta == nil || len(v.Delta.StopReason) == 0 {
+						continue
+					}
+					finishReason := openAIFinishReason(v.Delta.StopReason)
+					if forcedFormat && finishReason == "tool_calls" && toolCount == 0 {
+						finishReason = "stop"
+					}
+					data = chunk(&OpenAIResponseMessage{}, &finishReason)
+				case "message_stop":
+					if !includeUsage {
+						continue
+					}
+					usageChunk := chunk(nil, nil)
+					usageChunk.Choices = []*OpenAIChoice{}
+					usageChunk.Usage = newOpenAIUsage(usage)
+					data = usageChunk
+				default:
+					continue
+				}
+			default:
+				continue
+			}
+
+			if !send(data) {
+				return
+			}
+		}
+
+		select {
+		case chunkQueue <- &OpenAIStreamEvent{Data: []byte("[DONE]")}:
+		case <-ctx.Done():
+		}
+	}()
+
+	return chunkQueue
+}
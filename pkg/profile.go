@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	bedrockControl "github.com/aws/aws-sdk-go-v2/service/bedrock"
+	bedrockControlTypes "github.com/aws/aws-sdk-go-v2/service/bedrock/types"
+)
+
+// ---------------------
+// inference profiles
+// ---------------------
+// prefixes of system defined (cross-region) inference profile ids, e.g. us.anthropic.xxx
+var inferenceProfilePrefixes = []string{"us-gov", "us", "eu", "apac", "jp", "au", "ca", "global"}
+
+// region => inference profile prefixes of the region, the most specific first.
+// with discovered profiles the first prefix having a profile of the model is used,
+// otherwise the last one, the geography every model of the region is offered in
+var regionProfilePrefixes = map[string][]string{
+	"us-east-1":      {"us"},
+	"us-east-2":      {"us"},
+	"us-west-1":      {"us"},
+	"us-west-2":      {"us"},
+	"us-gov-east-1":  {"us-gov"},
+	"us-gov-west-1":  {"us-gov"},
+	"ca-central-1":   {"ca", "us"},
+	"ca-west-1":      {"ca", "us"},
+	"eu-central-1":   {"eu"},
+	"eu-central-2":   {"eu"},
+	"eu-north-1":     {"eu"},
+	"eu-south-1":     {"eu"},
+	"eu-south-2":     {"eu"},
+	"eu-west-1":      {"eu"},
+	"eu-west-2":      {"eu"},
+	"eu-west-3":      {"eu"},
+	"ap-northeast-1": {"jp", "apac"},
+	"ap-northeast-3": {"jp", "apac"},
+	"ap-southeast-2": {"au", "apac"},
+	"ap-southeast-4": {"au", "apac"},
+	"ap-east-2":      {"apac"},
+	"ap-northeast-2": {"apac"},
+	"ap-south-1":     {"apac"},
+	"ap-south-2":     {"apac"},
+	"ap-southeast-1": {"apac"},
+	"ap-southeast-3": {"apac"},
+	"ap-southeast-5": {"apac"},
+	"ap-southeast-7": {"apac"},
+}
+
+// inference_profile_prefix that picks the prefix of the region
+const InferenceProfilePrefixAuto = "auto"
+
+// max time of discovering inference profiles at startup
+const inferenceProfileDiscoveryTimeout = 10 * time.Second
+
+// inference profile prefixes of region, the most specific first,
+// empty if the region has no cross-region profiles
+func RegionInferenceProfilePrefixes(region string) []string {
+	return regionProfilePrefixes[region]
+}
+
+// the model id is an inference profile arn, system defined or application
+func IsInferenceProfileArn(modelId string) bool {
+	return strings.HasPrefix(modelId, "arn:") &&
+		(strings.Contains(modelId, ":inference-profile/") || strings.Contains(modelId, ":application-inference-profile/"))
+}
+
+// the model id is an application inference profile arn, the model is only known from discovery
+func IsApplicationInferenceProfile(modelId string) bool {
+	return strings.HasPrefix(modelId, "arn:") && strings.Contains(modelId, ":application-inference-profile/")
+}
+
+// prefix of system defined inference profile id or arn, empty if none
+func InferenceProfilePrefix(modelId string) string {
+	if IsInferenceProfileArn(modelId) {
+		modelId = modelId[strings.LastIndex(modelId, "/")+1:]
+	}
+	for _, prefix := range inferenceProfilePrefixes {
+		if strings.HasPrefix(modelId, prefix+".") {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// foundation model id of system defined inference profile id or arn,
+// e.g. us.anthropic.xxx => anthropic.xxx. application profiles need discovery
+func FoundationModelId(modelId string) string {
+	if IsApplicationInferenceProfile(modelId) {
+		if model, exist := applicationProfileModels.Load(modelId); exist {
+			return model.(string)
+		}
+		return modelId
+	}
+	if IsInferenceProfileArn(modelId) {
+		modelId = modelId[strings.LastIndex(modelId, "/")+1:]
+	}
+	prefix := InferenceProfilePrefix(modelId)
+	if len(prefix) > 0 {
+		return strings.TrimPrefix(modelId, prefix+".")
+	}
+	return modelId
+}
+
+// application inference profile arn => foundation model id, filled by discovery of all clients
+var applicationProfileModels sync.Map
+
+// inference profiles available to a client
+type inferenceProfileSet struct {
+	ids map[string]bool
+}
+
+func (profiles *inferenceProfileSet) Has(modelId string) bool {
+	return profiles != nil && profiles.ids[modelId]
+}
+
+// prefixes that may be added to bare model ids, the most specific first, empty if disabled
+func (config *BedrockConfig) GetInferenceProfilePrefixes() []string {
+	if strings.ToLower(config.InferenceProfilePrefix) == InferenceProfilePrefixAuto {
+		return RegionInferenceProfilePrefixes(config.GetRoleRegion())
+	}
+	if len(config.InferenceProfilePrefix) == 0 {
+		return nil
+	}
+	return []string{config.InferenceProfilePrefix}
+}
+
+// add the inference profile prefix of region to foundation model ids, e.g.
+// anthropic.xxx => us.anthropic.xxx. profile ids and arns are kept.
+// when profiles are discovered, the first prefix with an existing profile is used
+// and model ids without any are kept, otherwise the last prefix of region is used
+func (config *BedrockConfig) ResolveModelId(modelId string) string {
+	prefixes := config.GetInferenceProfilePrefixes()
+	if len(prefixes) == 0 || strings.HasPrefix(modelId, "arn:") || len(InferenceProfilePrefix(modelId)) > 0 {
+		return modelId
+	}
+	// aliases not in mappings are passed as is
+	if !strings.Contains(modelId, ".") {
+		return modelId
+	}
+	if config.inferenceProfiles == nil {
+		return prefixes[len(prefixes)-1] + "." + modelId
+	}
+	for _, prefix := range prefixes {
+		profileId := prefix + "." + modelId
+		if config.inferenceProfiles.Has(profileId) {
+			return profileId
+		}
+	}
+	return modelId
+}
+
+// list inference profiles with the credentials of client, validate model mappings against them
+// and use them to prefix model ids. the bedrock control-plane client shares the aws config of runtime
+func (client *BedrockClient) discoverInferenceProfiles(cfg aws.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), inferenceProfileDiscoveryTimeout)
+	defer cancel()
+
+	controlClient := bedrockControl.NewFromConfig(cfg)
+	profiles := &inferenceProfileSet{ids: map[string]bool{}}
+	for _, profileType := range []bedrockControlTypes.InferenceProfileType{
+		bedrockControlTypes.InferenceProfileTypeSystemDefined,
+		bedrockControlTypes.InferenceProfileTypeApplication,
+	} {
+		paginator := bedrockControl.NewListInferenceProfilesPaginator(controlClient, &bedrockControl.ListInferenceProfilesInput{
+			MaxResults: aws.Int32(1000),
+			TypeEquals: profileType,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, summary := range page.InferenceProfileSummaries {
+				profileArn := aws.ToString(summary.InferenceProfileArn)
+				profiles.ids[aws.ToString(summary.InferenceProfileId)] = true
+				profiles.ids[profileArn] = true
+				if profileType == bedrockControlTypes.InferenceProfileTypeApplication && len(summary.Models) > 0 {
+					// arn:aws:bedrock:region::foundation-model/anthropic.xxx
+					modelArn := aws.ToString(summary.Models[0].ModelArn)
+					modelId := FoundationModelId(modelArn[strings.LastIndex(modelArn, "/")+1:])
+					applicationProfileModels.Store(profileArn, modelId)
+				}
+			}
+		}
+	}
+	client.config.inferenceProfiles = profiles
+	Log.Infof("discovered %d inference profiles in %s", len(profiles.ids)/2, client.config.GetRoleRegion())
+
+	for alias := range client.config.ModelMappings {
+		for _, modelId := range client.config.GetModelChain(alias) {
+			isProfile := strings.HasPrefix(modelId, "arn:") || len(InferenceProfilePrefix(modelId)) > 0
+			if isProfile && !profiles.Has(modelId) {
+				Log.Warningf("model %s of %s is not an inference profile available in %s", modelId, alias, client.config.GetRoleRegion())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,854 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------
+// openai responses api
+// ---------------------
+// request.input[], a message or a function call / output item
+type OpenAIResponseInputItem struct {
+	Type      string          `json:"type,omitempty"`
+	Id        string          `json:"id,omitempty"`
+	Role      string          `json:"role,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	CallId    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	// reasoning items
+	Summary          []*OpenAIResponseSummary `json:"summary,omitempty"`
+	EncryptedContent string                   `json:"encrypted_content,omitempty"`
+}
+
+// request.input[].summary[], response.output[].summary[] of reasoning items
+type OpenAIResponseSummary struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// request.reasoning
+type OpenAIResponseReasoning struct {
+	Effort  string `json:"effort,omitempty"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// request.input[].content[]
+type OpenAIResponseInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Refusal  string `json:"refusal,omitempty"`
+	ImageUrl string `json:"image_url,omitempty"`
+	FileId   string `json:"file_id,omitempty"`
+}
+
+// request.tools[]
+type OpenAIResponseTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// request.text.format
+type OpenAIResponseTextFormat struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type OpenAIResponseText struct {
+	Format *OpenAIResponseTextFormat `json:"format,omitempty"`
+}
+
+// request
+type OpenAIResponseRequest struct {
+	Model              string                   `json:"model"`
+	Input              json.RawMessage          `json:"input"`
+	Instructions       string                   `json:"instructions,omitempty"`
+	MaxOutputTokens    int                      `json:"max_output_tokens,omitempty"`
+	Temperature        *float64                 `json:"temperature,omitempty"`
+	TopP               float64                  `json:"top_p,omitempty"`
+	Tools              []*OpenAIResponseTool    `json:"tools,omitempty"`
+	ToolChoice         json.RawMessage          `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool                    `json:"parallel_tool_calls,omitempty"`
+	Text               *OpenAIResponseText      `json:"text,omitempty"`
+	Reasoning          *OpenAIResponseReasoning `json:"reasoning,omitempty"`
+	Stream             bool                     `json:"stream,omitempty"`
+	Store              *bool                    `json:"store,omitempty"`
+	PreviousResponseId string                   `json:"previous_response_id,omitempty"`
+	User               string                   `json:"user,omitempty"`
+}
+
+// response.output[].content[]
+type OpenAIResponseOutputContent struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+// response.output[]
+type OpenAIResponseOutputItem struct {
+	Type      string                         `json:"type"`
+	Id        string                         `json:"id"`
+	Status    string                         `json:"status,omitempty"`
+	Role      string                         `json:"role,omitempty"`
+	Content   []*OpenAIResponseOutputContent `json:"content,omitempty"`
+	CallId    string                         `json:"call_id,omitempty"`
+	Name      string                         `json:"name,omitempty"`
+	Arguments string                         `json:"arguments,omitempty"`
+	// reasoning of claude thinking, encrypted_content keeps the signature to send it back
+	Summary          []*OpenAIResponseSummary `json:"summary,omitempty"`
+	EncryptedContent string                   `json:"encrypted_content,omitempty"`
+}
+
+// content of message items and arguments of function calls are required even when empty
+func (item OpenAIResponseOutputItem) MarshalJSON() ([]byte, error) {
+	type Alias OpenAIResponseOutputItem
+	switch item.Type {
+	case "message":
+		content := item.Content
+		if content == nil {
+			content = []*OpenAIResponseOutputContent{}
+		}
+		return json.Marshal(&struct {
+			Alias
+			Content []*OpenAIResponseOutputContent `json:"content"`
+		}{Alias(item), content})
+	case "function_call":
+		return json.Marshal(&struct {
+			Alias
+			Arguments string `json:"arguments"`
+		}{Alias(item), item.Arguments})
+	case "reasoning":
+		summary := item.Summary
+		if summary == nil {
+			summary = []*OpenAIResponseSummary{}
+		}
+		return json.Marshal(&struct {
+			Alias
+			Summary []*OpenAIResponseSummary `json:"summary"`
+		}{Alias(item), summary})
+	}
+	return json.Marshal(Alias(item))
+}
+
+// response.usage
+type OpenAIResponseUsage struct {
+	InputTokens        int                        `json:"input_tokens"`
+	InputTokensDetails *OpenAIPromptTokensDetails `json:"input_tokens_details,omitempty"`
+	OutputTokens       int                        `json:"output_tokens"`
+	TotalTokens        int                        `json:"total_tokens"`
+}
+
+// response.incomplete_details
+type OpenAIResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// response.error
+type OpenAIResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// response
+type OpenAIResponse struct {
+	Id                 string                           `json:"id"`
+	Object             string                           `json:"object"`
+	CreatedAt          int64                            `json:"created_at"`
+	Status             string                           `json:"status"`
+	Model              string                           `json:"model"`
+	Instructions       *string                          `json:"instructions"`
+	PreviousResponseId *string                          `json:"previous_response_id"`
+	Output             []*OpenAIResponseOutputItem      `json:"output"`
+	IncompleteDetails  *OpenAIResponseIncompleteDetails `json:"incomplete_details"`
+	Error              *OpenAIResponseError             `json:"error"`
+	Usage              *OpenAIResponseUsage             `json:"usage,omitempty"`
+}
+
+// response of deleting a stored response
+type OpenAIResponseDeleted struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// sse event, data is encoded when the event is created since the response keeps changing
+type OpenAIResponseStreamEvent struct {
+	Type string
+	Data []byte
+}
+
+func (event *OpenAIResponseStreamEvent) GetBytes() []byte {
+	return event.Data
+}
+
+func (event *OpenAIResponseStreamEvent) GetEvent() string {
+	return event.Type
+}
+
+func (event *OpenAIResponseStreamEvent) GetText() string {
+	return ""
+}
+
+// data of sse event
+type OpenAIResponseStreamEventData struct {
+	Type           string                    `json:"type"`
+	SequenceNumber int                       `json:"sequence_number"`
+	Response       *OpenAIResponse           `json:"response,omitempty"`
+	OutputIndex    *int                      `json:"output_index,omitempty"`
+	ContentIndex   *int                      `json:"content_index,omitempty"`
+	ItemId         string                    `json:"item_id,omitempty"`
+	Item           *OpenAIResponseOutputItem `json:"item,omitempty"`
+	SummaryIndex   *int                      `json:"summary_index,omitempty"`
+	Part           interface{}               `json:"part,omitempty"`
+	Delta          string                    `json:"delta,omitempty"`
+	Text           *string                   `json:"text,omitempty"`
+	Arguments      *string                   `json:"arguments,omitempty"`
+}
+
+// new response with the fields known before bedrock is called
+func (request *OpenAIResponseRequest) NewResponse() *OpenAIResponse {
+	response := &OpenAIResponse{
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "in_progress",
+		Model:     request.Model,
+		Output:    []*OpenAIResponseOutputItem{},
+	}
+	if len(request.Instructions) > 0 {
+		response.Instructions = &request.Instructions
+	}
+	if len(request.PreviousResponseId) > 0 {
+		response.PreviousResponseId = &request.PreviousResponseId
+	}
+	return response
+}
+
+// the response is kept for previous_response_id, default true
+func (request *OpenAIResponseRequest) IsStore() bool {
+	return request.Store == nil || *request.Store
+}
+
+// the response text is produced by a forced tool call
+func (request *OpenAIResponseRequest) IsForcedFormat() bool {
+	return request.Text != nil && request.Text.Format != nil && request.Text.Format.Type == "json_schema"
+}
+
+// convert to claude message request, the conversation continues from previous if not nil
+func (request *OpenAIResponseRequest) ToClaudeRequest(ctx context.Context, previous *StoredResponse) (*ClaudeMessageCompletionRequest, error) {
+	req := newOpenAIClaudeRequest(request.Model, request.Stream, request.MaxOutputTokens, request.Temperature, request.TopP, request.User)
+
+	// copy messages, appendClaudeMessage may change the last one
+	if previous != nil {
+		for _, message := range previous.Messages {
+			copied := *message
+			req.Messages = append(req.Messages, &copied)
+		}
+	}
+
+	systems := []string{}
+	if len(request.Instructions) > 0 {
+		systems = append(systems, request.Instructions)
+	}
+
+	items, err := parseResponseInput(request.Input)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			switch item.Role {
+			case "system", "developer":
+				blocks, err := responseContentBlocks(ctx, item.Content)
+				if err != nil {
+					return nil, err
+				}
+				for _, block := range blocks {
+					if block.Type != "text" {
+						return nil, NewInvalidRequestError(fmt.Errorf("unsupported content type %s for role %s", block.Type, item.Role))
+					}
+					systems = append(systems, block.Text)
+				}
+			case "user", "assistant":
+				blocks, err := responseContentBlocks(ctx, item.Content)
+				if err != nil {
+					return nil, err
+				}
+				appendClaudeMessage(req, item.Role, blocks)
+			default:
+				return nil, NewInvalidRequestError(fmt.Errorf("unknown message role: %s", item.Role))
+			}
+		case "function_call":
+			appendClaudeMessage(req, "assistant", []*ClaudeMessageRequestContent{newToolUseBlock(item.CallId, item.Name, item.Arguments)})
+		case "function_call_output":
+			// output is a string or an array of content
+			content := item.Output
+			var parts []*OpenAIResponseInputContent
+			if json.Unmarshal(item.Output, &parts) == nil {
+				blocks, err := responseContentBlocks(ctx, item.Output)
+				if err != nil {
+					return nil, err
+				}
+				content, _ = json.Marshal(blocks)
+			}
+			appendClaudeMessage(req, "user", []*ClaudeMessageRequestContent{{
+				Type:      "tool_result",
+				ToolUseId: item.CallId,
+				Content:   content,
+			}})
+		case "reasoning":
+			// reasoning summaries can not be sent back to claude without signature
+			block := reasoningThinkingBlock(item.Summary, item.EncryptedContent)
+			if block == nil {
+				Log.Debugf("skip reasoning item %s", item.Id)
+				continue
+			}
+			appendClaudeMessage(req, "assistant", []*ClaudeMessageRequestContent{block})
+		default:
+			return nil, NewInvalidRequestError(fmt.Errorf("unsupported input item type: %s", item.Type))
+		}
+	}
+	if len(req.Messages) == 0 {
+		return nil, NewInvalidRequestError(fmt.Errorf("input is required"))
+	}
+
+	for _, tool := range request.Tools {
+		if tool.Type != "function" {
+			return nil, NewInvalidRequestError(fmt.Errorf("unsupported tool type: %s", tool.Type))
+		}
+		claudeTool, err := newClaudeTool(tool.Name, tool.Description, tool.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		req.Tools = append(req.Tools, claudeTool)
+	}
+
+	toolChoice, err := parseResponseToolChoice(request.ToolChoice)
+	if err != nil {
+		return nil, err
+	}
+	setOpenAIToolChoice(req, toolChoice, request.ParallelToolCalls)
+
+	if request.Text != nil && request.Text.Format != nil {
+		format := request.Text.Format
+		systems, err = setOpenAIResponseFormat(req, systems, format.Type, format.Description, format.Schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+	setOpenAISystem(req, systems)
+
+	if request.Reasoning != nil {
+		err = setOpenAIReasoning(req, request.Reasoning.Effort, request.MaxOutputTokens > 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
+
+// prefix of encrypted_content of redacted thinking, it is the signature for thinking
+const redactedThinkingPrefix = "redacted_thinking:"
+
+// reasoning item of claude thinking / redacted_thinking block, nil for other blocks
+func newReasoningItem(id string, block *ClaudeMessageContentBlock) *OpenAIResponseOutputItem {
+	item := &OpenAIResponseOutputItem{Type: "reasoning", Id: id, Summary: []*OpenAIResponseSummary{}}
+	switch block.Type {
+	case "thinking":
+		if len(block.Thinking) > 0 {
+			item.Summary = append(item.Summary, &OpenAIResponseSummary{Type: "summary_text", Text: block.Thinking})
+		}
+		item.EncryptedContent = block.Signature
+	case "redacted_thinking":
+		item.EncryptedContent = redactedThinkingPrefix + block.Data
+	default:
+		return nil
+	}
+	return item
+}
+
+// claude thinking block of reasoning item, nil without encrypted_content
+func reasoningThinkingBlock(summary []*OpenAIResponseSummary, encryptedContent string) *ClaudeMessageRequestContent {
+	if len(encryptedContent) == 0 {
+		return nil
+	}
+	if data, found := strings.CutPrefix(encryptedContent, redactedThinkingPrefix); found {
+		return &ClaudeMessageRequestContent{Type: "redacted_thinking", Data: data}
+	}
+	texts := []string{}
+	for _, part := range summary {
+		texts = append(texts, part.Text)
+	}
+	return &ClaudeMessageRequestContent{
+		Type:      "thinking",
+		Thinking:  strings.Join(texts, ""),
+		Signature: encryptedContent,
+	}
+}
+
+// input is a string or an array of items
+func parseResponseInput(raw json.RawMessage) ([]*OpenAIResponseInputItem, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		content, _ := json.Marshal(text)
+		return []*OpenAIResponseInputItem{{Type: "message", Role: "user", Content: content}}, nil
+	}
+	var items []*OpenAIResponseInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid input, %v", err))
+	}
+	return items, nil
+}
+
+// content is a string or an array of input / output content
+func responseContentBlocks(ctx context.Context, raw json.RawMessage) ([]*ClaudeMessageRequestContent, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []*ClaudeMessageRequestContent{{Type: "text", Text: text}}, nil
+	}
+	var parts []*OpenAIResponseInputContent
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid content, %v", err))
+	}
+
+	blocks := []*ClaudeMessageRequestContent{}
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			blocks = append(blocks, &ClaudeMessageRequestContent{Type: "text", Text: part.Text})
+		case "refusal":
+			blocks = append(blocks, &ClaudeMessageRequestContent{Type: "text", Text: part.Refusal})
+		case "input_image":
+			if len(part.ImageUrl) == 0 {
+				return nil, NewInvalidRequestError(fmt.Errorf("input_image requires image_url, file_id is not supported"))
+			}
+			block, err := newImageBlock(ctx, part.ImageUrl)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		default:
+			return nil, NewInvalidRequestError(fmt.Errorf("unsupported content type: %s", part.Type))
+		}
+	}
+	return blocks, nil
+}
+
+// tool_choice is none / auto / required or {"type": "function", "name": ...}
+func parseResponseToolChoice(raw json.RawMessage) (*ClaudeMessageToolChoice, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var mode string
+	if json.Unmarshal(raw, &mode) == nil {
+		return parseOpenAIToolChoice(raw)
+	}
+	var choice OpenAIResponseTool
+	if err := json.Unmarshal(raw, &choice); err != nil || choice.Type != "function" {
+		return nil, NewInvalidRequestError(fmt.Errorf("invalid tool_choice"))
+	}
+	return &ClaudeMessageToolChoice{Type: "tool", Name: choice.Name}, nil
+}
+
+// resp_xxx of claude message id msg_xxx
+func newResponseId(messageId string) string {
+	return "resp_" + strings.TrimPrefix(messageId, "msg_")
+}
+
+// id of the output item at index
+func newResponseItemId(prefix string, responseId string, index int) string {
+	return fmt.Sprintf("%s_%s_%d", prefix, strings.TrimPrefix(responseId, "resp_"), index)
+}
+
+// status, incomplete_details and usage of a finished response
+func finishResponse(response *OpenAIResponse, stopReason string, usage *ClaudeMessageUsage) {
+	response.Status = "completed"
+	if stopReason == "max_tokens" {
+		response.Status = "incomplete"
+		response.IncompleteDetails = &OpenAIResponseIncompleteDetails{Reason: "max_output_tokens"}
+	}
+	if usage != nil {
+		// openai input tokens include the cached ones
+		inputTokens := usage.TotalInputTokens()
+		response.Usage = &OpenAIResponseUsage{
+			InputTokens:        inputTokens,
+			InputTokensDetails: &OpenAIPromptTokensDetails{CachedTokens: usage.CacheReadInputTokens},
+			OutputTokens:       usage.OutputTokens,
+			TotalTokens:        inputTokens + usage.OutputTokens,
+		}
+	}
+}
+
+// fill response with claude message response
+func FillOpenAIResponse(response *OpenAIResponse, forcedFormat bool, resp *ClaudeMessageCompletionResponse) {
+	response.Id = newResponseId(resp.Id)
+	for _, block := range resp.Content {
+		index := len(response.Output)
+		switch block.Type {
+		case "thinking", "redacted_thinking":
+			item := newReasoningItem(newResponseItemId("rs", response.Id, index), block)
+			item.Status = "completed"
+			response.Output = append(response.Output, item)
+		case "text":
+			response.Output = append(response.Output, &OpenAIResponseOutputItem{
+				Type:    "message",
+				Id:      newResponseItemId("msg", response.Id, index),
+				Status:  "completed",
+				Role:    "assistant",
+				Content: []*OpenAIResponseOutputContent{{Type: "output_text", Text: block.Text, Annotations: []interface{}{}}},
+			})
+		case "tool_use":
+			arguments, _ := json.Marshal(block.Input)
+			if forcedFormat && block.Name == openAIResponseFormatTool {
+				response.Output = append(response.Output, &OpenAIResponseOutputItem{
+					Type:    "message",
+					Id:      newResponseItemId("msg", response.Id, index),
+					Status:  "completed",
+					Role:    "assistant",
+					Content: []*OpenAIResponseOutputContent{{Type: "output_text", Text: string(arguments), Annotations: []interface{}{}}},
+				})
+				continue
+			}
+			response.Output = append(response.Output, &OpenAIResponseOutputItem{
+				Type:      "function_call",
+				Id:        newResponseItemId("fc", response.Id, index),
+				Status:    "completed",
+				CallId:    block.Id,
+				Name:      block.Name,
+				Arguments: string(arguments),
+			})
+		}
+	}
+	finishResponse(response, resp.StopReason, resp.Usage)
+}
+
+// convert claude sse events to responses api events, onComplete is called with the finished response
+func NewOpenAIResponseStream(ctx context.Context, response *OpenAIResponse, forcedFormat bool, queue <-chan ISSEDecoder, onComplete func(*OpenAIResponse)) <-chan ISSEDecoder {
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+
+	// output item of a claude content block
+	type outputBlock struct {
+		index int
+		item  *OpenAIResponseOutputItem
+	}
+
+	go func() {
+		defer close(eventQueue)
+
+		sequence := 0
+		stopReason := ""
+		usage := &ClaudeMessageUsage{}
+		blocks := map[int]*outputBlock{}
+		contentIndex := 0
+		summaryIndex := 0
+
+		// events of one claude event, encoded when added since the response keeps changing
+		var events []ISSEDecoder
+		add := func(data *OpenAIResponseStreamEventData) {
+			data.SequenceNumber = sequence
+			sequence++
+			raw, _ := json.Marshal(data)
+			events = append(events, &OpenAIResponseStreamEvent{Type: data.Type, Data: raw})
+		}
+		text := func(s string) *string {
+			return &s
+		}
+
+		for event := range queue {
+			events = nil
+			switch v := event.(type) {
+			case *SSEErrorEvent:
+				response.Status = "failed"
+				response.Error = &OpenAIResponseError{Code: v.Error.Type, Message: v.Error.Message}
+				add(&OpenAIResponseStreamEventData{Type: "response.failed", Response: response})
+			case *ClaudeMessageCompletionStreamEvent:
+				switch v.Type {
+				case "message_start":
+					if v.Message != nil {
+						response.Id = newResponseId(v.Message.Id)
+						mergeUsage(usage, v.Message.Usage)
+					}
+					add(&OpenAIResponseStreamEventData{Type: "response.created", Response: response})
+					add(&OpenAIResponseStreamEventData{Type: "response.in_progress", Response: response})
+				case "content_block_start":
+					if v.ContentBlock == nil {
+						continue
+					}
+					index := len(response.Output)
+					block := &outputBlock{index: index}
+					switch {
+					case v.ContentBlock.Type == "text",
+						v.ContentBlock.Type == "tool_use" && forcedFormat && v.ContentBlock.Name == openAIResponseFormatTool:
+						block.item = &OpenAIResponseOutputItem{
+							Type:    "message",
+							Id:      newResponseItemId("msg", response.Id, index),
+							Status:  "in_progress",
+							Role:    "assistant",
+							Content: []*OpenAIResponseOutputContent{},
+						}
+						part := &OpenAIResponseOutputContent{Type: "output_text", Annotations: []interface{}{}}
+						add(&OpenAIResponseStreamEventData{Type: "response.output_item.added", OutputIndex: &block.index, Item: block.item})
+						add(&OpenAIResponseStreamEventData{Type: "response.content_part.added", OutputIndex: &block.index, ContentIndex: &contentIndex, ItemId: block.item.Id, Part: part})
+						block.item.Content = append(block.item.Content, part)
+					case v.ContentBlock.Type == "tool_use":
+						block.item = &OpenAIResponseOutputItem{
+							Type:   "function_call",
+							Id:     newResponseItemId("fc", response.Id, index),
+							Status: "in_progress",
+							CallId: v.ContentBlock.Id,
+							Name:   v.ContentBlock.Name,
+						}
+						add(&OpenAIResponseStreamEventData{Type: "response.output_item.added", OutputIndex: &block.index, Item: block.item})
+					case v.ContentBlock.Type == "thinking", v.ContentBlock.Type == "redacted_thinking":
+						block.item = newReasoningItem(newResponseItemId("rs", response.Id, index), v.ContentBlock)
+						block.item.Status = "in_progress"
+						add(&OpenAIResponseStreamEventData{Type: "response.output_item.added", OutputIndex: &block.index, Item: block.item})
+						if v.ContentBlock.Type == "thinking" {
+							summary := &OpenAIResponseSummary{Type: "summary_text"}
+							add(&OpenAIResponseStreamEventData{Type: "response.reasoning_summary_part.added", OutputIndex: &block.index, SummaryIndex: &summaryIndex, ItemId: block.item.Id, Part: summary})
+							block.item.Summary = []*OpenAIResponseSummary{summary}
+						}
+					default:
+						continue
+					}
+					blocks[v.Index] = block
+					response.Output = append(response.Output, block.item)
+				case "content_block_delta":
+					block := blocks[v.Index]
+					if block == nil || v.Delta == nil {
+						continue
+					}
+					delta := v.Delta.Text
+					if v.Delta.Type == "input_json_delta" {
+						delta = v.Delta.PartialJson
+					}
+					if block.item.Type == "reasoning" {
+						switch v.Delta.Type {
+						case "thinking_delta":
+							block.item.Summary[0].Text += v.Delta.Thinking
+							add(&OpenAIResponseStreamEventData{Type: "response.reasoning_summary_text.delta", OutputIndex: &block.index, SummaryIndex: &summaryIndex, ItemId: block.item.Id, Delta: v.Delta.Thinking})
+						case "signature_delta":
+							block.item.EncryptedContent += v.Delta.Signature
+						}
+					} else if block.item.Type == "message" {
+						block.item.Content[0].Text += delta
+						add(&OpenAIResponseStreamEventData{Type: "response.output_text.delta", OutputIndex: &block.index, ContentIndex: &contentIndex, ItemId: block.item.Id, Delta: delta})
+					} else {
+						block.item.Arguments += delta
+						add(&OpenAIResponseStreamEventData{Type: "response.function_call_arguments.delta", OutputIndex: &block.index, ItemId: block.item.Id, Delta: delta})
+					}
+				case "content_block_stop":
+					block := blocks[v.Index]
+					if block == nil {
+						continue
+					}
+					block.item.Status = "completed"
+					if block.item.Type == "reasoning" {
+						if len(block.item.Summary) > 0 {
+							summary := block.item.Summary[0]
+							add(&OpenAIResponseStreamEventData{Type: "response.reasoning_summary_text.done", OutputIndex: &block.index, SummaryIndex: &summaryIndex, ItemId: block.item.Id, Text: text(summary.Text)})
+							add(&OpenAIResponseStreamEventData{Type: "response.reasoning_summary_part.done", OutputIndex: &block.index, SummaryIndex: &summaryIndex, ItemId: block.item.Id, Part: summary})
+						}
+					} else if block.item.Type == "message" {
+						part := block.item.Content[0]
+						add(&OpenAIResponseStreamEventData{Type: "response.output_text.done", OutputIndex: &block.index, ContentIndex: &contentIndex, ItemId: block.item.Id, Text: text(part.Text)})
+						add(&OpenAIResponseStreamEventData{Type: "response.content_part.done", OutputIndex: &block.index, ContentIndex: &contentIndex, ItemId: block.item.Id, Part: part})
+					} else {
+						add(&OpenAIResponseStreamEventData{Type: "response.function_call_arguments.done", OutputIndex: &block.index, ItemId: block.item.Id, Arguments: text(block.item.Arguments)})
+					}
+					add(&OpenAIResponseStreamEventData{Type: "response.output_item.done", OutputIndex: &block.index, Item: block.item})
+				case "message_delta":
+					mergeUsage(usage, v.Usage)
+					if v.Delta != nil && len(v.Delta.StopReason) > 0 {
+						stopReason = v.Delta.StopReason
+					}
+					continue
+				case "message_stop":
+					finishResponse(response, stopReason, usage)
+					eventType := "response.completed"
+					if response.Status == "incomplete" {
+						eventType = "response.incomplete"
+					}
+					add(&OpenAIResponseStreamEventData{Type: eventType, Response: response})
+					if onComplete != nil {
+						onComplete(response)
+					}
+				default:
+					continue
+				}
+			default:
+				continue
+			}
+
+			for _, sseEvent := range events {
+				select {
+				case eventQueue <- sseEvent:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return eventQueue
+}
+
+// ---------------------
+// stored responses for previous_response_id
+// ---------------------
+// max number, total size and lifetime of stored responses.
+// conversations keep inline images, so the size is bounded as well as the number
+const (
+	maxStoredResponses     = 1000
+	maxStoredResponseBytes = 256 << 20
+	storedResponseTTL      = time.Hour
+)
+
+// a response and the claude conversation that produced it
+type StoredResponse struct {
+	Response  *OpenAIResponse
+	Messages  []*ClaudeMessageCompletionRequestMessage
+	ExpiresAt time.Time
+	// json size of response and messages
+	size int
+}
+
+// in memory store of responses, oldest are evicted first
+type ResponseStore struct {
+	lock    sync.Mutex
+	entries map[string]*StoredResponse
+	size    int
+}
+
+func NewResponseStore() *ResponseStore {
+	return &ResponseStore{
+		entries: map[string]*StoredResponse{},
+	}
+}
+
+// keep response with the conversation of request and the response output appended
+func (store *ResponseStore) Save(response *OpenAIResponse, messages []*ClaudeMessageCompletionRequestMessage) {
+	entry := &StoredResponse{
+		Response:  response,
+		ExpiresAt: time.Now().Add(storedResponseTTL),
+	}
+	for _, message := range messages {
+		copied := *message
+		entry.Messages = append(entry.Messages, &copied)
+	}
+	req := &ClaudeMessageCompletionRequest{Messages: entry.Messages}
+	appendClaudeMessage(req, "assistant", responseOutputBlocks(response.Output))
+	entry.Messages = req.Messages
+	entry.size = storedResponseSize(entry)
+	if entry.size > maxStoredResponseBytes {
+		Log.Errorf("response %s is not stored, %d bytes is larger than the store", response.Id, entry.size)
+		return
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.remove(response.Id)
+	store.evict(entry.size)
+	store.entries[response.Id] = entry
+	store.size += entry.size
+}
+
+// json size of stored response, base64 image data included
+func storedResponseSize(entry *StoredResponse) int {
+	size := 0
+	if raw, err := json.Marshal(entry.Response); err == nil {
+		size += len(raw)
+	}
+	for _, message := range entry.Messages {
+		size += len(message.Content)
+	}
+	return size
+}
+
+// stored response, nil if not found or expired
+func (store *ResponseStore) Get(id string) *StoredResponse {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	entry, exist := store.entries[id]
+	if !exist || time.Now().After(entry.ExpiresAt) {
+		return nil
+	}
+	return entry
+}
+
+// remove stored response, return false if not found
+func (store *ResponseStore) Delete(id string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.remove(id)
+}
+
+func (store *ResponseStore) remove(id string) bool {
+	entry, exist := store.entries[id]
+	if exist {
+		store.size -= entry.size
+		delete(store.entries, id)
+	}
+	return exist
+}
+
+// drop expired entries, then the oldest ones until an entry of size fits
+func (store *ResponseStore) evict(size int) {
+	now := time.Now()
+	for id, entry := range store.entries {
+		if now.After(entry.ExpiresAt) {
+			store.remove(id)
+		}
+	}
+	for len(store.entries) > 0 && (len(store.entries) >= maxStoredResponses || store.size+size > maxStoredResponseBytes) {
+		oldestId := ""
+		var oldest time.Time
+		for id, entry := range store.entries {
+			if len(oldestId) == 0 || entry.ExpiresAt.Before(oldest) {
+				oldestId, oldest = id, entry.ExpiresAt
+			}
+		}
+		store.remove(oldestId)
+	}
+}
+
+// claude assistant blocks of response output
+func responseOutputBlocks(output []*OpenAIResponseOutputItem) []*ClaudeMessageRequestContent {
+	blocks := []*ClaudeMessageRequestContent{}
+	for _, item := range output {
+		switch item.Type {
+		case "reasoning":
+			if block := reasoningThinkingBlock(item.Summary, item.EncryptedContent); block != nil {
+				blocks = append(blocks, block)
+			}
+		case "message":
+			for _, part := range item.Content {
+				if len(part.Text) > 0 {
+					blocks = append(blocks, &ClaudeMessageRequestContent{Type: "text", Text: part.Text})
+				}
+			}
+		case "function_call":
+			blocks = append(blocks, newToolUseBlock(item.CallId, item.Name, item.Arguments))
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// ---------------------
+// retry of bedrock calls
+// ---------------------
+// defaults of retry config
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = 200
+	defaultRetryMaxDelay    = 5000
+	defaultRetryBudget      = 30000
+)
+
+// retries of throttled / unavailable bedrock calls. a retry goes to another
+// target if there is one, otherwise to the failover model of the same target
+type RetryConfig struct {
+	// attempts of one request including the first one, 1 disables retries
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// backoff in milliseconds, doubled on each retry and jittered
+	BaseDelay int `json:"base_delay,omitempty"`
+	MaxDelay  int `json:"max_delay,omitempty"`
+	// milliseconds a request may spend in retries
+	Budget int `json:"budget,omitempty"`
+	// alias or model id => model id used on failover, e.g. a cross-region inference profile
+	FailoverModels map[string]string `json:"failover_models,omitempty"`
+}
+
+// load retry config from env, nil if not set
+func loadRetryConfigWithEnv() *RetryConfig {
+	maxAttempts, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_RETRY_MAX_ATTEMPTS"))
+	baseDelay, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_RETRY_BASE_DELAY"))
+	maxDelay, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_RETRY_MAX_DELAY"))
+	budget, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_RETRY_BUDGET"))
+	failoverModels := ParseMappingsFromStr(os.Getenv("AWS_BEDROCK_FAILOVER_MODELS"))
+	if maxAttempts <= 0 && baseDelay <= 0 && maxDelay <= 0 && budget <= 0 && len(failoverModels) == 0 {
+		return nil
+	}
+	return &RetryConfig{
+		MaxAttempts:    maxAttempts,
+		BaseDelay:      baseDelay,
+		MaxDelay:       maxDelay,
+		Budget:         budget,
+		FailoverModels: failoverModels,
+	}
+}
+
+func (config *RetryConfig) GetMaxAttempts() int {
+	if config != nil && config.MaxAttempts > 0 {
+		return config.MaxAttempts
+	}
+	return defaultRetryMaxAttempts
+}
+
+func (config *RetryConfig) GetBudget() time.Duration {
+	if config != nil && config.Budget > 0 {
+		return time.Duration(config.Budget) * time.Millisecond
+	}
+	return defaultRetryBudget * time.Millisecond
+}
+
+// full jitter exponential backoff before the retry following attempt
+func (config *RetryConfig) GetBackoff(attempt int) time.Duration {
+	baseDelay, maxDelay := defaultRetryBaseDelay, defaultRetryMaxDelay
+	if config != nil && config.BaseDelay > 0 {
+		baseDelay = config.BaseDelay
+	}
+	if config != nil && config.MaxDelay > 0 {
+		maxDelay = config.MaxDelay
+	}
+	delay := baseDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)+1)) * time.Millisecond
+}
+
+func (config *RetryConfig) getFailoverModels() map[string]string {
+	if config == nil {
+		return nil
+	}
+	return config.FailoverModels
+}
+
+// throttling and transient server errors. upstream timeouts and model errors
+// (e.g. ModelTimeoutException) are not retried, they would take as long again
+func isRetryableError(err error) bool {
+	var smithyErr smithy.APIError
+	if errors.As(err, &smithyErr) && modelErrorCodes[smithyErr.ErrorCode()] {
+		return false
+	}
+	apiErr := TranslateError(err)
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, StatusOverloaded, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// client calling the failover models, nil if none is configured
+func (client *BedrockClient) withFailoverModels(failoverModels map[string]string) *BedrockClient {
+	if len(failoverModels) == 0 {
+		return nil
+	}
+	config := *client.config
+	config.ModelMappings = map[string]ModelChain{}
+	for alias, chain := range client.config.ModelMappings {
+		failoverChain := ModelChain{}
+		for _, modelId := range chain {
+			if failover, exist := failoverModels[modelId]; exist {
+				modelId = failover
+			}
+			failoverChain = append(failoverChain, modelId)
+		}
+		config.ModelMappings[alias] = failoverChain
+	}
+	for model, failover := range failoverModels {
+		config.ModelMappings[model] = ModelChain{failover}
+	}
+	return &BedrockClient{config: &config, client: client.client}
+}
+
+// wait for backoff, return false if ctx is done first
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// read the first event of stream before anything is sent to the client,
+// return the error if the stream failed right away with a retryable error
+func peekStream(ctx context.Context, response IStreamableResponse) (ISSEDecoder, error) {
+	select {
+	case event, ok := <-response.GetEvents():
+		if !ok {
+			return nil, nil
+		}
+		if errorEvent, ok := event.(*SSEErrorEvent); ok && isRetryableError(errorEvent.Error) {
+			return nil, errorEvent.Error
+		}
+		return event, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
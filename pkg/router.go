@@ -0,0 +1,627 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// ---------------------
+// routing between bedrock targets
+// ---------------------
+// response header naming the target that served the request
+const BedrockTargetHeader = "x-bedrock-target"
+
+// routing strategies
+const (
+	// smooth weighted round robin
+	RoutingWeighted = "weighted"
+	// fewest requests in flight relative to weight
+	RoutingLeastOutstanding = "least_outstanding"
+)
+
+// defaults of circuit breaker
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCooldown         = 30
+)
+
+// one account / region to send requests to, fields left empty are inherited from bedrock_config
+type BedrockTarget struct {
+	Name                 string              `json:"name,omitempty"`
+	Weight               int                 `json:"weight,omitempty"`
+	CredentialMode       string              `json:"credential_mode,omitempty"`
+	AccessKey            string              `json:"access_key,omitempty"`
+	SecretKey            string              `json:"secret_key,omitempty"`
+	Profile              string              `json:"profile,omitempty"`
+	WebIdentityRoleArn   string              `json:"web_identity_role_arn,omitempty"`
+	WebIdentityTokenFile string              `json:"web_identity_token_file,omitempty"`
+	Region               string              `json:"region,omitempty"`
+	RoleArn              string              `json:"role_arn,omitempty"`
+	RoleRegion           string              `json:"role_region,omitempty"`
+	RoleExternalId       string              `json:"role_external_id,omitempty"`
+	RoleSessionName      string              `json:"role_session_name,omitempty"`
+	RoleDurationSeconds  int                 `json:"role_duration_seconds,omitempty"`
+	RoleSessionTags      map[string]string   `json:"role_session_tags,omitempty"`
+	RoleChain            []*AssumeRoleConfig `json:"role_chain,omitempty"`
+	// merged over model_mappings, e.g. inference profiles of this account
+	ModelMappings map[string]ModelChain `json:"model_mappings,omitempty"`
+}
+
+// take a target out of rotation after consecutive failures
+type CircuitBreakerConfig struct {
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// seconds before a trial request is let through
+	Cooldown int `json:"cooldown,omitempty"`
+}
+
+func (config *CircuitBreakerConfig) GetFailureThreshold() int {
+	if config != nil && config.FailureThreshold > 0 {
+		return config.FailureThreshold
+	}
+	return defaultBreakerFailureThreshold
+}
+
+func (config *CircuitBreakerConfig) GetCooldown() time.Duration {
+	if config != nil && config.Cooldown > 0 {
+		return time.Duration(config.Cooldown) * time.Second
+	}
+	return defaultBreakerCooldown * time.Second
+}
+
+// targets of AWS_BEDROCK_TARGET_REGIONS, region=weight pairs sharing the credentials of bedrock config
+func parseTargetRegions(raw string) []*BedrockTarget {
+	targets := []*BedrockTarget{}
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		region := strings.TrimSpace(kv[0])
+		if len(region) == 0 {
+			continue
+		}
+		weight := 1
+		if len(kv) == 2 {
+			weight, _ = strconv.Atoi(strings.TrimSpace(kv[1]))
+		}
+		targets = append(targets, &BedrockTarget{Name: region, Region: region, Weight: weight})
+	}
+	return targets
+}
+
+// load circuit breaker config from env, nil if not set
+func loadCircuitBreakerWithEnv() *CircuitBreakerConfig {
+	threshold, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_BREAKER_FAILURE_THRESHOLD"))
+	cooldown, _ := strconv.Atoi(os.Getenv("AWS_BEDROCK_BREAKER_COOLDOWN"))
+	if threshold <= 0 && cooldown <= 0 {
+		return nil
+	}
+	return &CircuitBreakerConfig{FailureThreshold: threshold, Cooldown: cooldown}
+}
+
+// targets of bedrock config, the config itself if no target is configured
+func (config *BedrockConfig) GetTargets() []*BedrockTarget {
+	if len(config.Targets) > 0 {
+		return config.Targets
+	}
+	name := config.Region
+	if len(name) == 0 {
+		name = "default"
+	}
+	return []*BedrockTarget{{Name: name}}
+}
+
+// bedrock config of target
+func (config *BedrockConfig) ForTarget(target *BedrockTarget) *BedrockConfig {
+	derived := *config
+	derived.Targets = nil
+	override := func(value *string, targetValue string) {
+		if len(targetValue) > 0 {
+			*value = targetValue
+		}
+	}
+	override(&derived.CredentialMode, target.CredentialMode)
+	override(&derived.AccessKey, target.AccessKey)
+	override(&derived.SecretKey, target.SecretKey)
+	override(&derived.Profile, target.Profile)
+	override(&derived.WebIdentityRoleArn, target.WebIdentityRoleArn)
+	override(&derived.WebIdentityTokenFile, target.WebIdentityTokenFile)
+	override(&derived.RoleArn, target.RoleArn)
+	override(&derived.RoleExternalId, target.RoleExternalId)
+	override(&derived.RoleSessionName, target.RoleSessionName)
+	if len(target.Region) > 0 {
+		derived.Region = target.Region
+		// role_region of bedrock_config belongs to another region
+		derived.RoleRegion = ""
+	}
+	override(&derived.RoleRegion, target.RoleRegion)
+	if target.RoleDurationSeconds > 0 {
+		derived.RoleDurationSeconds = target.RoleDurationSeconds
+	}
+	if len(target.RoleSessionTags) > 0 {
+		derived.RoleSessionTags = target.RoleSessionTags
+	}
+	if len(target.RoleChain) > 0 {
+		derived.RoleChain = target.RoleChain
+	}
+	if len(target.ModelMappings) > 0 {
+		derived.ModelMappings = map[string]ModelChain{}
+		for key, value := range config.ModelMappings {
+			derived.ModelMappings[key] = value
+		}
+		for key, value := range target.ModelMappings {
+			derived.ModelMappings[key] = value
+		}
+	}
+	return &derived
+}
+
+// call to bedrock made by the router with the client of the picked target.
+// non-stream results other than IStreamableResponse can be kept by the closure
+type RouteCall func(ctx context.Context, client *BedrockClient) (IStreamableResponse, error)
+
+// spreads requests over targets, targets failing repeatedly are skipped until cooldown
+type BedrockRouter struct {
+	routing string
+	retry   *RetryConfig
+	targets []*routeTarget
+	// guards outstanding and weights of targets
+	lock sync.Mutex
+}
+
+// state of one target
+type routeTarget struct {
+	name    string
+	weight  int
+	config  *BedrockConfig
+	breaker *circuitBreaker
+
+	clientLock sync.RWMutex
+	client     *BedrockClient
+	clientErr  error
+
+	// guarded by router lock
+	outstanding   int
+	currentWeight int
+}
+
+// create router and the clients of all targets, targets failing to
+// create a client keep retrying in background
+func NewBedrockRouter(config *BedrockConfig) *BedrockRouter {
+	router := &BedrockRouter{routing: config.Routing, retry: config.Retry}
+	names := map[string]int{}
+	for i, target := range config.GetTargets() {
+		name := target.Name
+		if len(name) == 0 {
+			name = target.Region
+		}
+		if len(name) == 0 {
+			name = fmt.Sprintf("target-%d", i)
+		}
+		// names are reported in header, keep them unique
+		names[name]++
+		if names[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, names[name])
+		}
+		weight := target.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		routeTarget := &routeTarget{
+			name:    name,
+			weight:  weight,
+			config:  config.ForTarget(target),
+			breaker: newCircuitBreaker(config.CircuitBreaker),
+		}
+		router.targets = append(router.targets, routeTarget)
+		if !routeTarget.initClient() {
+			go routeTarget.retryInitClient()
+		}
+	}
+	return router
+}
+
+// create the bedrock client of target, return false on failure
+func (target *routeTarget) initClient() bool {
+	client, err := NewBedrockClient(target.config)
+
+	target.clientLock.Lock()
+	defer target.clientLock.Unlock()
+	if err != nil {
+		Log.Errorf("unable to create bedrock client of %s, %v", target.name, err)
+		target.clientErr = err
+		return false
+	}
+	target.client = client
+	target.clientErr = nil
+	return true
+}
+
+// keep retrying with backoff until bedrock client is created
+func (target *routeTarget) retryInitClient() {
+	interval := bedrockInitMinInterval
+	for {
+		time.Sleep(interval)
+		Log.Infof("retry creating bedrock client of %s", target.name)
+		if target.initClient() {
+			Log.Infof("bedrock client of %s created", target.name)
+			return
+		}
+		interval *= 2
+		if interval > bedrockInitMaxInterval {
+			interval = bedrockInitMaxInterval
+		}
+	}
+}
+
+// bedrock client of target, or the reason it is not available
+func (target *routeTarget) getClient() (*BedrockClient, error) {
+	target.clientLock.RLock()
+	defer target.clientLock.RUnlock()
+	if target.client == nil {
+		if target.clientErr == nil {
+			return nil, fmt.Errorf("bedrock client is not ready")
+		}
+		return nil, target.clientErr
+	}
+	return target.client, nil
+}
+
+// pick a target with client ready, skip the ones with open breaker and
+// the tried ones unless all of them are tried. fails fast if all breakers are open.
+// outstanding of the picked target is increased
+func (router *BedrockRouter) pick(tried map[*routeTarget]bool) (*routeTarget, *BedrockClient, error) {
+	var firstErr error
+	ready := []*routeTarget{}
+	clients := map[*routeTarget]*BedrockClient{}
+	for _, target := range router.targets {
+		client, err := target.getClient()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ready = append(ready, target)
+		clients[target] = client
+	}
+	if len(ready) == 0 {
+		return nil, nil, firstErr
+	}
+
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	healthy := []*routeTarget{}
+	for _, target := range ready {
+		if target.breaker.Available() {
+			healthy = append(healthy, target)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, nil, newTargetsUnavailableError(ready)
+	}
+	untried := []*routeTarget{}
+	for _, target := range healthy {
+		if !tried[target] {
+			untried = append(untried, target)
+		}
+	}
+	if len(untried) > 0 {
+		healthy = untried
+	}
+
+	var picked *routeTarget
+	switch router.routing {
+	case RoutingLeastOutstanding:
+		for _, target := range healthy {
+			// outstanding / weight, compared without division
+			if picked == nil || target.outstanding*picked.weight < picked.outstanding*target.weight {
+				picked = target
+			}
+		}
+	default:
+		total := 0
+		for _, target := range healthy {
+			target.currentWeight += target.weight
+			total += target.weight
+			if picked == nil || target.currentWeight > picked.currentWeight {
+				picked = target
+			}
+		}
+		picked.currentWeight -= total
+	}
+	picked.breaker.Acquire()
+	picked.outstanding++
+	return picked, clients[picked], nil
+}
+
+// request of target finished
+func (router *BedrockRouter) release(target *routeTarget, ctx context.Context, err error) {
+	router.lock.Lock()
+	target.outstanding--
+	router.lock.Unlock()
+
+	if err == nil {
+		target.breaker.Success()
+		return
+	}
+	if isTargetFailure(err) && ctx.Err() != context.Canceled {
+		if target.breaker.Failure() {
+			Log.Warningf("circuit breaker of %s opened, %v", target.name, err)
+			CountMetric("breaker_open." + target.name)
+		}
+		return
+	}
+	// the client went away, or the request / model failed: nothing to learn about the target
+	target.breaker.Abort()
+}
+
+// error when the breakers of all targets are open, retry-after is the shortest cooldown left
+func newTargetsUnavailableError(targets []*routeTarget) error {
+	retryAfter := time.Duration(0)
+	for i, target := range targets {
+		left := target.breaker.CooldownLeft()
+		if i == 0 || left < retryAfter {
+			retryAfter = left
+		}
+	}
+	Log.Warningf("all bedrock targets are unhealthy")
+	CountMetric("targets_unavailable")
+	return &ClaudeAPIError{
+		Type:       ErrorTypeOverloaded,
+		StatusCode: http.StatusServiceUnavailable,
+		RetryAfter: int(math.Max(1, math.Ceil(retryAfter.Seconds()))),
+		Message:    "all bedrock targets are unavailable, circuit breakers are open",
+	}
+}
+
+// errors of bedrock concerning one model, not the target
+var modelErrorCodes = map[string]bool{
+	"ModelErrorException":       true,
+	"ModelTimeoutException":     true,
+	"ModelNotReadyException":    true,
+	"ModelStreamErrorException": true,
+}
+
+// errors caused by the target rather than the request or the model: transport errors,
+// throttling and server errors. access denied and not found errors may only concern
+// one model id, they must not take the target out for all models
+func isTargetFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var smithyErr smithy.APIError
+	if errors.As(err, &smithyErr) {
+		code := smithyErr.ErrorCode()
+		if modelErrorCodes[code] {
+			return false
+		}
+		switch code {
+		case "ThrottlingException", "TooManyRequestsException", "ServiceUnavailableException", "InternalServerException":
+			return true
+		}
+	}
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) {
+		status := responseErr.HTTPStatusCode()
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	// bedrock could not be reached
+	var sendErr *smithyhttp.RequestSendError
+	return errors.As(err, &sendErr)
+}
+
+// call bedrock with the picked target, return the name of the target.
+// throttled or failed calls are retried with backoff on other targets or failover models,
+// streams are retried only if they fail before the first event.
+// for streams the target is released once the event queue is closed
+func (router *BedrockRouter) Invoke(ctx context.Context, call RouteCall) (IStreamableResponse, string, error) {
+	start := time.Now()
+	tried := map[*routeTarget]bool{}
+	maxAttempts := router.retry.GetMaxAttempts()
+	for attempt := 1; ; attempt++ {
+		target, client, err := router.pick(tried)
+		if err != nil {
+			return nil, "", err
+		}
+		CountMetric("target_requests." + target.name)
+		// no other target left, fail over to another model of the same target
+		if tried[target] {
+			failoverClient := client.withFailoverModels(router.retry.getFailoverModels())
+			if failoverClient != nil {
+				Log.Infof("fail over to failover models of %s", target.name)
+				CountMetric("failovers")
+				client = failoverClient
+			}
+		}
+		tried[target] = true
+
+		response, err := call(ctx, client)
+		var first ISSEDecoder
+		if err == nil && response != nil && response.IsStream() {
+			first, err = peekStream(ctx, response)
+		}
+		if err == nil {
+			if response == nil || !response.IsStream() {
+				router.release(target, ctx, nil)
+				return response, target.name, nil
+			}
+			return &routedStreamResponse{
+				IStreamableResponse: response,
+				events:              router.watchStream(ctx, target, first, response.GetEvents()),
+			}, target.name, nil
+		}
+		router.release(target, ctx, err)
+
+		if !isRetryableError(err) || ctx.Err() != nil {
+			return nil, target.name, err
+		}
+		if attempt >= maxAttempts {
+			CountMetric("retries_exhausted")
+			return nil, target.name, err
+		}
+		delay := router.retry.GetBackoff(attempt)
+		if time.Since(start)+delay > router.retry.GetBudget() {
+			Log.Warningf("retry budget of request exhausted after %d attempts, %v", attempt, err)
+			CountMetric("retries_exhausted")
+			return nil, target.name, err
+		}
+		Log.Warningf("attempt %d on %s failed, retry in %v, %v", attempt, target.name, delay, err)
+		CountMetric("retries")
+		CountMetric("retries." + target.name)
+		if !sleepContext(ctx, delay) {
+			return nil, target.name, err
+		}
+	}
+}
+
+// stream response with events forwarded by the router
+type routedStreamResponse struct {
+	IStreamableResponse
+	events <-chan ISSEDecoder
+}
+
+func (response *routedStreamResponse) GetEvents() <-chan ISSEDecoder {
+	return response.events
+}
+
+// forward first and the events of queue, release target when the stream ends,
+// an error event counts as failure
+func (router *BedrockRouter) watchStream(ctx context.Context, target *routeTarget, first ISSEDecoder, queue <-chan ISSEDecoder) <-chan ISSEDecoder {
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+
+	go func() {
+		defer close(eventQueue)
+		var streamErr error
+		defer func() {
+			router.release(target, ctx, streamErr)
+		}()
+
+		forward := func(event ISSEDecoder) bool {
+			if errorEvent, ok := event.(*SSEErrorEvent); ok {
+				streamErr = errorEvent.Error
+			}
+			select {
+			case eventQueue <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if first != nil && !forward(first) {
+			return
+		}
+		for event := range queue {
+			if !forward(event) {
+				return
+			}
+		}
+	}()
+
+	return eventQueue
+}
+
+// states of circuit breaker
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// consecutive failures open the breaker, after cooldown one trial request
+// is let through, its result closes or reopens the breaker
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock     sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func newCircuitBreaker(config *CircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: config.GetFailureThreshold(),
+		cooldown:  config.GetCooldown(),
+	}
+}
+
+// the target may receive a request, the caller must Acquire the picked target
+func (breaker *circuitBreaker) Available() bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	switch breaker.state {
+	case breakerOpen:
+		return time.Since(breaker.openedAt) >= breaker.cooldown
+	case breakerHalfOpen:
+		// only one trial request at a time
+		return !breaker.trial
+	}
+	return true
+}
+
+// time until a trial request is let through, 0 if the breaker is not open
+func (breaker *circuitBreaker) CooldownLeft() time.Duration {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if breaker.state != breakerOpen {
+		return 0
+	}
+	left := breaker.cooldown - time.Since(breaker.openedAt)
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// a request is sent to the target, it is the trial request if the cooldown has passed
+func (breaker *circuitBreaker) Acquire() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if breaker.state == breakerOpen && time.Since(breaker.openedAt) >= breaker.cooldown {
+		breaker.state = breakerHalfOpen
+	}
+	if breaker.state == breakerHalfOpen {
+		breaker.trial = true
+	}
+}
+
+// the request ended without telling anything about the target
+func (breaker *circuitBreaker) Abort() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.trial = false
+}
+
+func (breaker *circuitBreaker) Success() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.state = breakerClosed
+	breaker.failures = 0
+	breaker.trial = false
+}
+
+// record a failure, return true if the breaker is opened by it
+func (breaker *circuitBreaker) Failure() bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.failures++
+	if breaker.state == breakerHalfOpen || (breaker.state == breakerClosed && breaker.failures >= breaker.threshold) {
+		breaker.state = breakerOpen
+		breaker.openedAt = time.Now()
+		breaker.trial = false
+		return true
+	}
+	return false
+}
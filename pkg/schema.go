@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ---------------------
+// json schema of tools
+// ---------------------
+// schema of tools without input_schema, e.g. openai functions without parameters
+var emptyInputSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+
+// primitive types of json schema
+var jsonSchemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "string": true, "integer": true,
+}
+
+// keywords whose value is a schema
+var jsonSchemaSchemaKeywords = []string{
+	"not", "additionalProperties", "additionalItems", "contains", "propertyNames",
+	"if", "then", "else", "unevaluatedProperties", "unevaluatedItems",
+}
+
+// keywords whose value is an object of schemas
+var jsonSchemaMapKeywords = []string{
+	"properties", "patternProperties", "$defs", "definitions", "dependentSchemas",
+}
+
+// keywords whose value is a non-empty array of schemas
+var jsonSchemaArrayKeywords = []string{"allOf", "anyOf", "oneOf", "prefixItems"}
+
+// keywords whose value is a non-negative integer
+var jsonSchemaCountKeywords = []string{
+	"minLength", "maxLength", "minItems", "maxItems", "minProperties", "maxProperties",
+	"minContains", "maxContains",
+}
+
+// keywords whose value is a string
+var jsonSchemaStringKeywords = []string{
+	"$ref", "$schema", "$id", "$anchor", "$comment", "title", "description", "format", "pattern",
+	"contentEncoding", "contentMediaType",
+}
+
+// error at path of schema
+func jsonSchemaError(path string, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...))
+}
+
+// check the schema is a legal json schema, the error names the path of the problem.
+// keywords unknown to the validator are accepted and passed through
+func ValidateJSONSchema(path string, raw json.RawMessage) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var schema interface{}
+	err := decoder.Decode(&schema)
+	if err != nil {
+		return jsonSchemaError(path, "invalid json, %v", err)
+	}
+	return validateJSONSchema(path, schema)
+}
+
+func validateJSONSchema(path string, schema interface{}) error {
+	// true / false are schemas too
+	if _, ok := schema.(bool); ok {
+		return nil
+	}
+	object, ok := schema.(map[string]interface{})
+	if !ok {
+		return jsonSchemaError(path, "schema must be an object or boolean")
+	}
+
+	if value, exist := object["type"]; exist {
+		types, ok := value.([]interface{})
+		if !ok {
+			types = []interface{}{value}
+		}
+		if len(types) == 0 {
+			return jsonSchemaError(path+".type", "must not be empty")
+		}
+		for _, item := range types {
+			name, ok := item.(string)
+			if !ok || !jsonSchemaTypes[name] {
+				return jsonSchemaError(path+".type", "unknown type %v", item)
+			}
+		}
+	}
+
+	for _, keyword := range jsonSchemaSchemaKeywords {
+		if value, exist := object[keyword]; exist {
+			err := validateJSONSchema(path+"."+keyword, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, keyword := range jsonSchemaMapKeywords {
+		value, exist := object[keyword]
+		if !exist {
+			continue
+		}
+		schemas, ok := value.(map[string]interface{})
+		if !ok {
+			return jsonSchemaError(path+"."+keyword, "must be an object")
+		}
+		for name, item := range schemas {
+			err := validateJSONSchema(path+"."+keyword+"."+name, item)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, keyword := range jsonSchemaArrayKeywords {
+		value, exist := object[keyword]
+		if !exist {
+			continue
+		}
+		schemas, ok := value.([]interface{})
+		if !ok || len(schemas) == 0 {
+			return jsonSchemaError(path+"."+keyword, "must be a non-empty array")
+		}
+		for i, item := range schemas {
+			err := validateJSONSchema(fmt.Sprintf("%s.%s.%d", path, keyword, i), item)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// items is a schema, or an array of schemas in older drafts
+	if value, exist := object["items"]; exist {
+		if schemas, ok := value.([]interface{}); ok {
+			for i, item := range schemas {
+				err := validateJSONSchema(fmt.Sprintf("%s.items.%d", path, i), item)
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			err := validateJSONSchema(path+".items", value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if value, exist := object["required"]; exist {
+		names, ok := value.([]interface{})
+		if !ok {
+			return jsonSchemaError(path+".required", "must be an array of strings")
+		}
+		seen := map[string]bool{}
+		for _, item := range names {
+			name, ok := item.(string)
+			if !ok {
+				return jsonSchemaError(path+".required", "must be an array of strings")
+			}
+			if seen[name] {
+				return jsonSchemaError(path+".required", "duplicate property %s", name)
+			}
+			seen[name] = true
+		}
+	}
+
+	if value, exist := object["enum"]; exist {
+		if _, ok := value.([]interface{}); !ok {
+			return jsonSchemaError(path+".enum", "must be an array")
+		}
+	}
+
+	for _, keyword := range jsonSchemaCountKeywords {
+		value, exist := object[keyword]
+		if !exist {
+			continue
+		}
+		number, ok := value.(json.Number)
+		count, err := number.Float64()
+		if !ok || err != nil || count < 0 || count != math.Trunc(count) {
+			return jsonSchemaError(path+"."+keyword, "must be a non-negative integer")
+		}
+	}
+
+	for _, keyword := range []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf"} {
+		value, exist := object[keyword]
+		if !exist {
+			continue
+		}
+		// exclusiveMinimum / exclusiveMaximum are booleans in draft 4
+		if _, ok := value.(bool); ok && strings.HasPrefix(keyword, "exclusive") {
+			continue
+		}
+		number, ok := value.(json.Number)
+		if !ok {
+			return jsonSchemaError(path+"."+keyword, "must be a number")
+		}
+		if keyword == "multipleOf" {
+			if factor, err := number.Float64(); err != nil || factor <= 0 {
+				return jsonSchemaError(path+".multipleOf", "must be greater than 0")
+			}
+		}
+	}
+
+	for _, keyword := range jsonSchemaStringKeywords {
+		value, exist := object[keyword]
+		if !exist {
+			continue
+		}
+		if _, ok := value.(string); !ok {
+			return jsonSchemaError(path+"."+keyword, "must be a string")
+		}
+	}
+
+	if value, exist := object["uniqueItems"]; exist {
+		if _, ok := value.(bool); !ok {
+			return jsonSchemaError(path+".uniqueItems", "must be a boolean")
+		}
+	}
+	return nil
+}
+
+// input_schema of custom tools must be an object schema,
+// type is "object" or an array of type names holding "object", e.g. ["object", "null"]
+func validateInputSchema(path string, raw json.RawMessage) error {
+	err := ValidateJSONSchema(path, raw)
+	if err != nil {
+		return err
+	}
+	var schema struct {
+		Type interface{} `json:"type"`
+	}
+	json.Unmarshal(raw, &schema)
+	switch value := schema.Type.(type) {
+	case string:
+		if value == "object" {
+			return nil
+		}
+	case []interface{}:
+		for _, item := range value {
+			if item == "object" {
+				return nil
+			}
+		}
+	}
+	return jsonSchemaError(path+".type", "must be \"object\" or an array holding \"object\"")
+}
+
+// validate input_schema of custom tools, anthropic defined tools have none.
+// the error names the path of the problem, e.g. tools.0.input_schema.properties.city.type
+func (request *ClaudeMessageCompletionRequest) ValidateTools() error {
+	for i, tool := range request.Tools {
+		if tool == nil {
+			return fmt.Errorf("tools.%d: tool is required", i)
+		}
+		path := fmt.Sprintf("tools.%d.input_schema", i)
+		if len(tool.Type) > 0 && tool.Type != "custom" {
+			if len(tool.InputSchema) > 0 {
+				err := ValidateJSONSchema(path, tool.InputSchema)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if len(tool.InputSchema) == 0 {
+			return fmt.Errorf("%s: field required", path)
+		}
+		err := validateInputSchema(path, tool.InputSchema)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateTools(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		// path named by the error, empty if valid
+		errPath string
+	}{
+		{"object", `{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`, ""},
+		{"empty properties", `{"type":"object","properties":{}}`, ""},
+		{"nested", `{"type":"object","properties":{"tags":{"type":"array","items":{"type":"string"},"minItems":1}}}`, ""},
+		{"combined types", `{"type":"object","properties":{"value":{"type":["string","null"]}}}`, ""},
+		{"refs", `{"type":"object","$defs":{"id":{"type":"integer"}},"properties":{"id":{"$ref":"#/$defs/id"}}}`, ""},
+		{"boolean schemas", `{"type":"object","properties":{"any":true},"additionalProperties":false}`, ""},
+		{"object or null", `{"type":["object","null"],"properties":{}}`, ""},
+		{"missing type", `{"properties":{"city":{"type":"string"}}}`, "tools.0.input_schema.type"},
+		{"string root", `{"type":"string"}`, "tools.0.input_schema.type"},
+		{"array type without object", `{"type":["string","null"]}`, "tools.0.input_schema.type"},
+		{"array root", `[{"type":"object"}]`, "tools.0.input_schema"},
+		{"boolean root", `true`, "tools.0.input_schema.type"},
+		{"invalid json", `{"type":"object"`, "tools.0.input_schema"},
+		{"unknown type", `{"type":"object","properties":{"city":{"type":"text"}}}`, "tools.0.input_schema.properties.city.type"},
+		{"properties not object", `{"type":"object","properties":[]}`, "tools.0.input_schema.properties"},
+		{"empty anyOf", `{"type":"object","anyOf":[]}`, "tools.0.input_schema.anyOf"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &ClaudeMessageCompletionRequest{Tools: []*ClaudeMessageCompletionRequestTools{
+				{Name: "get_weather", InputSchema: json.RawMessage(test.schema)},
+			}}
+			err := request.ValidateTools()
+			if len(test.errPath) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error at %s", test.errPath)
+			}
+			if !strings.HasPrefix(err.Error(), test.errPath+":") {
+				t.Fatalf("expected error at %s, got %v", test.errPath, err)
+			}
+		})
+	}
+}
+
+func TestValidateToolsMissingSchema(t *testing.T) {
+	request := &ClaudeMessageCompletionRequest{Tools: []*ClaudeMessageCompletionRequestTools{
+		{Name: "get_weather"},
+	}}
+	err := request.ValidateTools()
+	if err == nil || !strings.HasPrefix(err.Error(), "tools.0.input_schema:") {
+		t.Fatalf("expected missing input_schema error, got %v", err)
+	}
+
+	// anthropic defined tools have no input_schema
+	request.Tools[0].Type = "bash_20250124"
+	err = request.ValidateTools()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestValidateToolsKeepsUnknownKeywords(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{"root", `{"type":"object","x-vendor":{"a":[1,2]},"properties":{}}`},
+		{"nested", `{"type":"object","properties":{"city":{"type":"string","x-order":1,"examples":["Paris"]}}}`},
+		{"large numbers", `{"type":"object","properties":{"id":{"type":"integer","maximum":12345678901234567890}}}`},
+		{"key order", `{"properties":{"b":{"type":"string"},"a":{"type":"string"}},"type":"object","strict":true}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := `{"model":"claude","max_tokens":1,"messages":[],"tools":[{"name":"get_weather","input_schema":` + test.schema + `}]}`
+			request := &ClaudeMessageCompletionRequest{}
+			err := json.Unmarshal([]byte(raw), request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = request.ValidateTools()
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			body, err := json.Marshal(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var encoded struct {
+				Tools []struct {
+					InputSchema json.RawMessage `json:"input_schema"`
+				} `json:"tools"`
+			}
+			err = json.Unmarshal(body, &encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encoded.Tools) != 1 || string(encoded.Tools[0].InputSchema) != test.schema {
+				t.Fatalf("input_schema changed, got %s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// ---------------------
+// bedrock stream pump
+// ---------------------
+// event stream of InvokeModelWithResponseStream,
+// implemented by *bedrockruntime.InvokeModelWithResponseStreamEventStream
+type IBedrockEventStream interface {
+	Events() <-chan types.ResponseStream
+	Close() error
+	Err() error
+}
+
+// decode one chunk payload to sse event
+type ChunkDecoder func(payload []byte) (ISSEDecoder, error)
+
+// size of the queue between bedrock stream and sse writer
+const streamQueueSize = 10
+
+// how long the error event of a timed out stream waits for the writer
+const streamErrorTimeout = 5 * time.Second
+
+// read stream in a goroutine and send decoded events to the returned queue.
+// the queue is bounded, so the stream is only read as fast as the writer consumes it.
+// when ctx is done the goroutine closes the stream and the queue and returns,
+// release is called once the goroutine exits.
+func PumpBedrockStream(ctx context.Context, stream IBedrockEventStream, decode ChunkDecoder, release func()) <-chan ISSEDecoder {
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+
+	go func() {
+		defer release()
+		defer stream.Close()
+		defer close(eventQueue)
+
+		for {
+			var event types.ResponseStream
+			var ok bool
+			select {
+			case <-ctx.Done():
+				Log.Debugf("stop reading bedrock stream, %v", ctx.Err())
+				sendStreamError(ctx, nil, eventQueue)
+				return
+			case event, ok = <-stream.Events():
+				if !ok {
+					sendStreamError(ctx, stream.Err(), eventQueue)
+					return
+				}
+			}
+
+			switch v := event.(type) {
+			case *types.ResponseStreamMemberChunk:
+				resp, err := decode(v.Value.Bytes)
+				if err != nil {
+					Log.Error(err)
+					continue
+				}
+				select {
+				case eventQueue <- resp:
+				case <-ctx.Done():
+					Log.Debugf("stop reading bedrock stream, %v", ctx.Err())
+					sendStreamError(ctx, nil, eventQueue)
+					return
+				}
+
+			case *types.UnknownUnionMember:
+				Log.Errorf("unknown tag: %s", v.Tag)
+				continue
+			default:
+				Log.Errorf("union is nil or unknown type")
+				continue
+			}
+		}
+	}()
+
+	return eventQueue
+}
+
+// bedrock stream ended with exception (internal, throttling, model stream error...),
+// or the upstream timeout was reached mid-stream.
+// forward it as an anthropic error event so the client does not see a truncated answer
+func sendStreamError(ctx context.Context, err error, eventQueue chan<- ISSEDecoder) {
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if timedOut {
+		err = fmt.Errorf("bedrock stream timed out, %w", ctx.Err())
+	} else if err == nil || ctx.Err() != nil {
+		return
+	}
+	errorEvent := NewSSEErrorEvent(err)
+	Log.Errorf("bedrock stream failed, %s: %v", errorEvent.Error.Type, err)
+	CountMetric("stream_errors")
+	CountMetric("stream_errors." + errorEvent.Error.Type)
+
+	if !timedOut {
+		select {
+		case eventQueue <- errorEvent:
+		case <-ctx.Done():
+		}
+		return
+	}
+	// ctx is already done, the writer may have gone too, so only wait a moment for it
+	timer := time.NewTimer(streamErrorTimeout)
+	defer timer.Stop()
+	select {
+	case eventQueue <- errorEvent:
+	case <-timer.C:
+		Log.Debugf("drop error event of timed out stream")
+	}
+}
+
+// sse error event
+type SSEErrorEvent struct {
+	Error *ClaudeAPIError
+}
+
+func NewSSEErrorEvent(err error) *SSEErrorEvent {
+	return &SSEErrorEvent{Error: TranslateError(err)}
+}
+
+func (event *SSEErrorEvent) GetBytes() []byte {
+	raw, _ := json.Marshal(&APIStandardError{Type: "error", Error: &APIError{
+		Type:    event.Error.Type,
+		Message: event.Error.Message,
+	}})
+	return raw
+}
+
+func (event *SSEErrorEvent) GetEvent() string {
+	return "error"
+}
+
+func (event *SSEErrorEvent) GetText() string {
+	return event.Error.Message
+}
+
+// sse keep-alive ping event
+type SSEPingEvent struct{}
+
+func (event *SSEPingEvent) GetBytes() []byte {
+	return []byte(`{"type": "ping"}`)
+}
+
+func (event *SSEPingEvent) GetEvent() string {
+	return "ping"
+}
+
+func (event *SSEPingEvent) GetText() string {
+	return ""
+}
@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// bedrock event stream fed by the test
+type fakeEventStream struct {
+	events chan types.ResponseStream
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeEventStream(chunks int) *fakeEventStream {
+	stream := &fakeEventStream{
+		events: make(chan types.ResponseStream, chunks),
+		closed: make(chan struct{}),
+	}
+	for i := 0; i < chunks; i++ {
+		stream.events <- &types.ResponseStreamMemberChunk{Value: types.PayloadPart{
+			Bytes: []byte(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"hi"}}`),
+		}}
+	}
+	return stream
+}
+
+func (stream *fakeEventStream) Events() <-chan types.ResponseStream {
+	return stream.events
+}
+
+func (stream *fakeEventStream) Close() error {
+	stream.once.Do(func() { close(stream.closed) })
+	return nil
+}
+
+func (stream *fakeEventStream) Err() error {
+	return nil
+}
+
+// response writer failing after limit writes, a negative limit never fails
+type fakeSSEWriter struct {
+	header http.Header
+	writes int
+	limit  int
+}
+
+func newFakeSSEWriter(limit int) *fakeSSEWriter {
+	return &fakeSSEWriter{header: http.Header{}, limit: limit}
+}
+
+func (writer *fakeSSEWriter) Header() http.Header {
+	return writer.header
+}
+
+func (writer *fakeSSEWriter) Write(data []byte) (int, error) {
+	if writer.limit >= 0 && writer.writes >= writer.limit {
+		return 0, errors.New("broken pipe")
+	}
+	writer.writes++
+	return len(data), nil
+}
+
+func (writer *fakeSSEWriter) WriteHeader(statusCode int) {}
+
+func (writer *fakeSSEWriter) Flush() {}
+
+func decodeFakeChunk(payload []byte) (ISSEDecoder, error) {
+	return &ClaudeMessageCompletionStreamEvent{Type: "content_block_delta", Raw: payload}, nil
+}
+
+func newStreamTestService() *HTTPService {
+	return &HTTPService{conf: &Config{HttpConfig: HttpConfig{PingInterval: -1}}}
+}
+
+// wait for the goroutines started by the test to exit
+func waitGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked, %d running, %d before", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// wait for the pump to release the stream
+func waitReleased(t *testing.T, stream *fakeEventStream, released <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-released:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pump did not release the stream")
+	}
+	select {
+	case <-stream.closed:
+	default:
+		t.Fatal("pump did not close the stream")
+	}
+}
+
+func TestPumpStopsOnFailedWriter(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	// more chunks than the queue holds, the pump blocks on the full queue once the writer fails
+	stream := newFakeEventStream(streamQueueSize * 5)
+	released := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := PumpBedrockStream(ctx, stream, decodeFakeChunk, func() { close(released) })
+
+	err := newStreamTestService().ResponseSSE(newFakeSSEWriter(3), queue)
+	if err == nil {
+		t.Fatal("expected write error")
+	}
+	cancel()
+
+	waitReleased(t, stream, released)
+	waitGoroutines(t, baseline)
+}
+
+func TestPumpStopsOnCancelledRequest(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	// bedrock stays silent after the first chunks
+	stream := newFakeEventStream(3)
+	released := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := PumpBedrockStream(ctx, stream, decodeFakeChunk, func() { close(released) })
+
+	writer := newFakeSSEWriter(-1)
+	done := make(chan error, 1)
+	go func() {
+		done <- newStreamTestService().ResponseSSE(writer, queue)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer did not return after the request was cancelled")
+	}
+	if writer.writes != 3 {
+		t.Fatalf("expected 3 frames, got %d", writer.writes)
+	}
+
+	waitReleased(t, stream, released)
+	waitGoroutines(t, baseline)
+}
+
+func TestPumpSendsErrorOnTimeout(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	stream := newFakeEventStream(0)
+	released := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	queue := PumpBedrockStream(ctx, stream, decodeFakeChunk, func() { close(released) })
+
+	var last ISSEDecoder
+	for event := range queue {
+		last = event
+	}
+	if last == nil || last.GetEvent() != "error" {
+		t.Fatalf("expected error event, got %v", last)
+	}
+
+	waitReleased(t, stream, released)
+	waitGoroutines(t, baseline)
+}
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"context"
+)
+
+// ---------------------
+// token usage metrics
+// ---------------------
+// add usage to the token counters, in total and by foundation model,
+// e.g. input_tokens and input_tokens.anthropic.claude-3-5-sonnet-20241022-v2:0.
+// cache writes and reads are billed at other rates than input tokens, so they are counted apart
+func CountUsage(modelId string, usage *ClaudeMessageUsage) {
+	if usage == nil {
+		return
+	}
+	model := FoundationModelId(modelId)
+	add := func(name string, tokens int) {
+		if tokens <= 0 {
+			return
+		}
+		Metrics.Add(name, int64(tokens))
+		Metrics.Add(name+"."+model, int64(tokens))
+	}
+	add("input_tokens", usage.InputTokens)
+	add("output_tokens", usage.OutputTokens)
+	add("cache_creation_input_tokens", usage.CacheCreationInputTokens)
+	add("cache_read_input_tokens", usage.CacheReadInputTokens)
+	if usage.CacheCreation != nil {
+		add("cache_creation_5m_input_tokens", usage.CacheCreation.Ephemeral5mInputTokens)
+		add("cache_creation_1h_input_tokens", usage.CacheCreation.Ephemeral1hInputTokens)
+	}
+}
+
+// merge usage of a stream event, counts of message_delta are cumulative and replace the ones of message_start
+func mergeUsage(total *ClaudeMessageUsage, usage *ClaudeMessageUsage) {
+	if usage == nil {
+		return
+	}
+	if usage.InputTokens > 0 {
+		total.InputTokens = usage.InputTokens
+	}
+	if usage.OutputTokens > 0 {
+		total.OutputTokens = usage.OutputTokens
+	}
+	if usage.CacheCreationInputTokens > 0 {
+		total.CacheCreationInputTokens = usage.CacheCreationInputTokens
+	}
+	if usage.CacheReadInputTokens > 0 {
+		total.CacheReadInputTokens = usage.CacheReadInputTokens
+	}
+	if usage.CacheCreation != nil {
+		total.CacheCreation = usage.CacheCreation
+	}
+}
+
+// count the usage of response, streams are counted when they end
+func withUsageMetrics(ctx context.Context, response IStreamableResponse, modelId string) IStreamableResponse {
+	if !response.IsStream() {
+		resp, ok := response.GetResponse().(*ClaudeMessageCompletionResponse)
+		if ok && resp != nil {
+			CountUsage(modelId, resp.Usage)
+		}
+		return response
+	}
+
+	eventQueue := make(chan ISSEDecoder, streamQueueSize)
+	go func() {
+		defer close(eventQueue)
+		usage := &ClaudeMessageUsage{}
+		defer func() {
+			CountUsage(modelId, usage)
+		}()
+		for event := range response.GetEvents() {
+			if v, ok := event.(*ClaudeMessageCompletionStreamEvent); ok {
+				switch v.Type {
+				case "message_start":
+					if v.Message != nil {
+						mergeUsage(usage, v.Message.Usage)
+					}
+				case "message_delta":
+					mergeUsage(usage, v.Usage)
+				}
+			}
+			select {
+			case eventQueue <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return NewStreamMessageCompleteResponse(eventQueue)
+}
@@ -1,5 +1,6 @@
+import time
 import pytest
-from anthropic import Anthropic, NotFoundError
+from anthropic import Anthropic, NotFoundError, AuthenticationError, BadRequestError
 from langchain_anthropic import ChatAnthropic
 
 PROXY_BASE_URL = "http://localhost:3000"
@@ -163,29 +164,50 @@ def test_tool_use_answer(client: Anthropic):
 # 测试错误场景
 def test_invalid_api_key():
     invalid_client = Anthropic(base_url=PROXY_BASE_URL, api_key="invalid_key")
-    response = invalid_client.messages.create(
-        model=PROXY_MODEL_ID,
-        max_tokens=1000,
-        messages=[{"role": "user", "content": "Hello"}]
-    )
-    assert response.type == "error"
-    assert response.error["type"] == "invalid_request_error"
-    assert response.error["message"] == "invalid api key"
+    with pytest.raises(AuthenticationError) as exc_info:
+        invalid_client.messages.create(
+            model=PROXY_MODEL_ID,
+            max_tokens=1000,
+            messages=[{"role": "user", "content": "Hello"}]
+        )
+    assert exc_info.value.status_code == 401
+    assert exc_info.value.body["error"]["type"] == "authentication_error"
+    assert exc_info.value.body["error"]["message"] == "invalid api key"
 
 # 测试模型参数限制
 def test_token_limit(client):
     long_message = "test " * 5000000  # 创建一个很长的消息
-    response = client.messages.create(
-        model=PROXY_MODEL_ID,
-        max_tokens=1000,
-        messages=[{"role": "user", "content": long_message}]
-    )
-    assert response.type == "error"
-    assert response.error["type"] == "invalid_request_error"
-    assert response.error["message"].find(
+    with pytest.raises(BadRequestError) as exc_info:
+        client.messages.create(
+            model=PROXY_MODEL_ID,
+            max_tokens=1000,
+            messages=[{"role": "user", "content": long_message}]
+        )
+    assert exc_info.value.status_code == 400
+    assert exc_info.value.body["error"]["type"] == "invalid_request_error"
+    assert exc_info.value.body["error"]["message"].find(
         "ValidationException: 1 validation error detected: Value at 'body' failed to satisfy constraint: Member must have length less than or equal to"
     ) > 0
 
+# 测试非法的工具 input_schema
+def test_invalid_tool_schema(client):
+    with pytest.raises(BadRequestError) as exc_info:
+        client.messages.create(
+            model=PROXY_MODEL_ID,
+            max_tokens=1000,
+            tools=[{
+                "name": "get_weather",
+                "input_schema": {
+                    "type": "object",
+                    "properties": {"location": {"type": "text"}}
+                }
+            }],
+            messages=[{"role": "user", "content": "What is the weather like in San Francisco?"}]
+        )
+    assert exc_info.value.status_code == 400
+    assert exc_info.value.body["error"]["type"] == "invalid_request_error"
+    assert exc_info.value.body["error"]["message"] == "tools.0.input_schema.properties.location.type: unknown type text"
+
 
 # 测试系统提示词
 def test_system_prompt(client):
@@ -255,7 +277,60 @@ def test_count_tokens(client, base_message):
         ]
     )
     print(response)
-    assert(response.error is None)
+    assert response.input_tokens > 0
+
+# 测试旧版 text completion，Claude 3 以上模型通过 messages api 完成
+def test_text_completion(client, base_message):
+    response = client.completions.create(
+        model=PROXY_MODEL_ID,
+        max_tokens_to_sample=100,
+        prompt=f"\n\nHuman: {base_message}\n\nAssistant:"
+    )
+    print(response)
+    assert len(response.completion) > 0
+    assert response.stop_reason in ("stop_sequence", "max_tokens")
+
+# 测试模型列表
+def test_list_models(client):
+    models = client.models.list(limit=5)
+    print(models)
+    assert len(models.data) > 0
+    assert models.data[0].type == "model"
+
+    model = client.models.retrieve(PROXY_MODEL_ID)
+    assert model.id == PROXY_MODEL_ID
+
+    with pytest.raises(NotFoundError):
+        client.models.retrieve("not-exist-model")
+
+# 测试 message batches，批量请求由本地 worker 完成
+def test_message_batches(client, base_message):
+    batch = client.messages.batches.create(requests=[
+        {"custom_id": f"req-{i}", "params": {
+            "model": PROXY_MODEL_ID,
+            "max_tokens": 100,
+            "messages": [{"role": "user", "content": base_message}],
+        }} for i in range(2)
+    ])
+    print(batch)
+    assert batch.type == "message_batch"
+    assert batch.request_counts.processing == 2
+
+    for _ in range(60):
+        batch = client.messages.batches.retrieve(batch.id)
+        if batch.processing_status == "ended":
+            break
+        time.sleep(2)
+    assert batch.processing_status == "ended"
+    assert batch.request_counts.succeeded == 2
+
+    results = list(client.messages.batches.results(batch.id))
+    assert sorted(r.custom_id for r in results) == ["req-0", "req-1"]
+    assert results[0].result.type == "succeeded"
+
+    client.messages.batches.delete(batch.id)
+    with pytest.raises(NotFoundError):
+        client.messages.batches.retrieve(batch.id)
 
 # 测试beta能力：prompt_cache
 def test_prompt_cache(client):
@@ -277,6 +352,9 @@ def test_prompt_cache(client):
     )
     print(response)
     assert response.error is None
+    # 缓存的 token 单独统计
+    assert response.usage.cache_creation_input_tokens is not None
+    assert response.usage.cache_read_input_tokens is not None
 
 def test_prompt_cache_stream(client):
     stream = client.beta.prompt_caching.messages.create(
@@ -297,14 +375,20 @@ def test_prompt_cache_stream(client):
         messages=[{"role": "user", "content": "Analyze the major themes in 'Pride and Prejudice'."}],
     )
     collected_message = ""
+    start_usage = None
     print("\n==== chunks begin ====")
     for chunk in stream:
         print(chunk)
         print(chunk.type)
+        if chunk.type == "message_start":
+            start_usage = chunk.message.usage
         if chunk.type == "content_block_delta":
             collected_message += chunk.delta.text
     print("---- chunks end----")
     assert len(collected_message) > 0
+    assert start_usage is not None
+    assert start_usage.cache_creation_input_tokens is not None
+    assert start_usage.cache_read_input_tokens is not None
     
 # --------------
 # 3.langchain调用
@@ -321,3 +405,71 @@ def chat_model():
 def testChatAnthropic(chat_model):
     response = chat_model.invoke("say this is a test")
     assert response.content is not None
+
+# --------------
+# 4.openai sdk调用
+# --------------
+@pytest.fixture
+def openai_client():
+    from openai import OpenAI
+    return OpenAI(base_url=PROXY_BASE_URL + "/v1", api_key=PROXY_API_KEY)
+
+def test_openai_chat_completion(openai_client, base_message):
+    response = openai_client.chat.completions.create(
+        model=PROXY_MODEL_ID,
+        messages=[
+            {"role": "system", "content": "You are a helpful assistant."},
+            {"role": "user", "content": base_message}
+        ]
+    )
+    print(response)
+    assert response.choices[0].message.content is not None
+    assert response.choices[0].finish_reason == "stop"
+    assert response.usage.prompt_tokens > 0
+
+def test_openai_chat_completion_stream(openai_client, base_message):
+    stream = openai_client.chat.completions.create(
+        model=PROXY_MODEL_ID,
+        messages=[{"role": "user", "content": base_message}],
+        stream=True,
+        stream_options={"include_usage": True}
+    )
+    collected_message = ""
+    for chunk in stream:
+        print(chunk)
+        if len(chunk.choices) > 0 and chunk.choices[0].delta.content:
+            collected_message += chunk.choices[0].delta.content
+    assert len(collected_message) > 0
+
+def test_openai_responses(openai_client, base_message):
+    response = openai_client.responses.create(
+        model=PROXY_MODEL_ID,
+        instructions="You are a helpful assistant.",
+        input=base_message
+    )
+    print(response)
+    assert len(response.output_text) > 0
+
+    follow_up = openai_client.responses.create(
+        model=PROXY_MODEL_ID,
+        previous_response_id=response.id,
+        input="say it again"
+    )
+    assert len(follow_up.output_text) > 0
+
+def test_openai_responses_stream(openai_client, base_message):
+    stream = openai_client.responses.create(
+        model=PROXY_MODEL_ID,
+        input=base_message,
+        stream=True
+    )
+    collected_message = ""
+    completed = False
+    for event in stream:
+        print(event)
+        if event.type == "response.output_text.delta":
+            collected_message += event.delta
+        if event.type == "response.completed":
+            completed = True
+    assert len(collected_message) > 0
+    assert completed